@@ -2,7 +2,11 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -18,13 +22,13 @@ import (
 
 func Init() {
 	if config.Get().SessionStorage.RedisAddr != "" {
-		if err := fedcache.UseRedisCache(
-			&redis.Options{
-				Addr: config.Get().SessionStorage.RedisAddr,
-			},
-		); err != nil {
+		options := &redis.Options{
+			Addr: config.Get().SessionStorage.RedisAddr,
+		}
+		if err := fedcache.UseRedisCache(options); err != nil {
 			log.WithError(err).Fatal("could not init redis cache")
 		}
+		redisClient = redis.NewClient(options)
 	}
 	if config.Get().SessionStorage.MemCachedAddr != "" {
 		memcached = memcache.New(config.Get().SessionStorage.MemCachedAddr)
@@ -36,12 +40,28 @@ func Init() {
 
 var memcached *memcache.Client
 
+// redisClient is used for the session indexes, which are stored as redis
+// sets, so that they can be updated atomically
+var redisClient *redis.Client
+
+// sessionIndexMu serializes the read-modify-write updates of the session
+// indexes if they are stored in the in-memory cache
+var sessionIndexMu sync.Mutex
+
 const (
-	KeySessions  = "session"
-	KeyStateData = "state_data"
+	KeySessions      = "session"
+	KeyStateData     = "state_data"
+	KeyOPJWKS        = "op_jwks"
+	KeyOPTrustChains = "op_trust_chains"
+	KeyLogout        = "logout_state"
+	KeyBearer        = "bearer_token"
+
+	KeySessionIndexSub = "session_index_sub"
+	KeySessionIndexSID = "session_index_sid"
+	KeyLogoutTokenJTI  = "logout_token_jti"
 )
 
-func memCacheStore(key string, claims model.UserClaims) error {
+func memCacheStore(key string, claims model.UserClaims, ttl time.Duration) error {
 	memCachedClaims := config.Get().SessionStorage.MemCachedClaims
 	if memCachedClaims == nil {
 		memCachedClaims = config.DefaultMemCachedClaims
@@ -66,29 +86,193 @@ func memCacheStore(key string, claims model.UserClaims) error {
 			&memcache.Item{
 				Key:        key,
 				Value:      value,
-				Expiration: int32(config.Get().SessionStorage.TTL),
+				Expiration: int32(ttl.Seconds()),
 			},
 		),
 	)
 }
 
-func SetSession(key string, value model.UserClaims) error {
+// SetSession stores a session. The session is stored until its ExpiresAt;
+// if ExpiresAt is not set, it is set according to the configured session ttl.
+func SetSession(key string, value model.Session) error {
+	if value.ExpiresAt.IsZero() {
+		value.ExpiresAt = time.Now().Add(time.Duration(config.Get().SessionStorage.TTL) * time.Second)
+	}
+	ttl := time.Until(value.ExpiresAt)
+	if ttl <= 0 {
+		return errors.New("session already expired")
+	}
 	if memcached != nil {
-		if err := memCacheStore(key, value); err != nil {
+		if err := memCacheStore(key, value.Claims, ttl); err != nil {
 			return err
 		}
 	}
-	return errors.WithStack(
-		fedcache.Set(
-			fedcache.Key(KeySessions, key), value, time.Duration(config.Get().SessionStorage.TTL)*time.Second,
-		),
-	)
+	if err := indexSession(key, value.Claims); err != nil {
+		return err
+	}
+	return errors.WithStack(fedcache.Set(fedcache.Key(KeySessions, key), value, ttl))
 }
 
-func GetSession(key string, target *model.UserClaims) (bool, error) {
+func GetSession(key string, target *model.Session) (bool, error) {
 	return fedcache.Get(fedcache.Key(KeySessions, key), target)
 }
 
+// DeleteSession deletes a session from the session cache and (if used)
+// from memcached
+func DeleteSession(key string) error {
+	if memcached != nil {
+		if err := memcached.Delete(key); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(fedcache.Set(fedcache.Key(KeySessions, key), nil, time.Nanosecond))
+}
+
+// SessionIndexKey returns the key used in the session index for the
+// combination of an issuer and a sub or sid value
+func SessionIndexKey(issuer, value string) string {
+	return base64.URLEncoding.EncodeToString([]byte(issuer)) + ":" + base64.URLEncoding.EncodeToString([]byte(value))
+}
+
+// indexSession adds the session to the indexes by (iss, sub) and (iss, sid),
+// so it can be found on a back-channel logout
+func indexSession(sessionID string, claims model.UserClaims) error {
+	iss, _ := claims.GetString("iss")
+	if iss == "" {
+		return nil
+	}
+	if sub, ok := claims.GetString("sub"); ok && sub != "" {
+		if err := addToSessionIndex(KeySessionIndexSub, SessionIndexKey(iss, sub), sessionID); err != nil {
+			return err
+		}
+	}
+	if sid, ok := claims.GetString("sid"); ok && sid != "" {
+		if err := addToSessionIndex(KeySessionIndexSID, SessionIndexKey(iss, sid), sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnindexSession removes the session from the indexes it was added to by
+// SetSession
+func UnindexSession(sessionID string, claims model.UserClaims) error {
+	iss, _ := claims.GetString("iss")
+	if iss == "" {
+		return nil
+	}
+	if sub, ok := claims.GetString("sub"); ok && sub != "" {
+		if err := removeFromSessionIndex(KeySessionIndexSub, SessionIndexKey(iss, sub), sessionID); err != nil {
+			return err
+		}
+	}
+	if sid, ok := claims.GetString("sid"); ok && sid != "" {
+		if err := removeFromSessionIndex(KeySessionIndexSID, SessionIndexKey(iss, sid), sessionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sessionIndexTTL() time.Duration {
+	return time.Duration(config.Get().SessionStorage.TTL) * time.Second
+}
+
+func addToSessionIndex(index, key, sessionID string) error {
+	ttl := sessionIndexTTL()
+	if redisClient != nil {
+		ctx := context.Background()
+		k := fedcache.Key(index, key)
+		_, err := redisClient.TxPipelined(
+			ctx, func(pipe redis.Pipeliner) error {
+				pipe.SAdd(ctx, k, sessionID)
+				pipe.Expire(ctx, k, ttl)
+				return nil
+			},
+		)
+		return errors.WithStack(err)
+	}
+	sessionIndexMu.Lock()
+	defer sessionIndexMu.Unlock()
+	var sessionIDs []string
+	if _, err := Get(index, key, &sessionIDs); err != nil {
+		return err
+	}
+	if !slices.Contains(sessionIDs, sessionID) {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	return Set(index, key, sessionIDs, ttl)
+}
+
+func removeFromSessionIndex(index, key, sessionID string) error {
+	if redisClient != nil {
+		return errors.WithStack(redisClient.SRem(context.Background(), fedcache.Key(index, key), sessionID).Err())
+	}
+	sessionIndexMu.Lock()
+	defer sessionIndexMu.Unlock()
+	var sessionIDs []string
+	if _, err := Get(index, key, &sessionIDs); err != nil {
+		return err
+	}
+	i := slices.Index(sessionIDs, sessionID)
+	if i < 0 {
+		return nil
+	}
+	sessionIDs = slices.Delete(sessionIDs, i, i+1)
+	if len(sessionIDs) == 0 {
+		return Set(index, key, nil, time.Nanosecond)
+	}
+	return Set(index, key, sessionIDs, sessionIndexTTL())
+}
+
+// takeSessionIndex returns the session ids of an index entry and deletes
+// the entry
+func takeSessionIndex(index, key string) ([]string, error) {
+	if redisClient != nil {
+		ctx := context.Background()
+		k := fedcache.Key(index, key)
+		var members *redis.StringSliceCmd
+		_, err := redisClient.TxPipelined(
+			ctx, func(pipe redis.Pipeliner) error {
+				members = pipe.SMembers(ctx, k)
+				pipe.Del(ctx, k)
+				return nil
+			},
+		)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return members.Val(), nil
+	}
+	sessionIndexMu.Lock()
+	defer sessionIndexMu.Unlock()
+	var sessionIDs []string
+	if _, err := Get(index, key, &sessionIDs); err != nil {
+		return nil, err
+	}
+	return sessionIDs, Set(index, key, nil, time.Nanosecond)
+}
+
+// RevokeSessions deletes all sessions for the passed issuer and sid,
+// or if no sid is given, all sessions for the issuer and sub.
+// It returns the number of revoked sessions.
+func RevokeSessions(issuer, sub, sid string) (int, error) {
+	index, key := KeySessionIndexSub, SessionIndexKey(issuer, sub)
+	if sid != "" {
+		index, key = KeySessionIndexSID, SessionIndexKey(issuer, sid)
+	}
+	sessionIDs, err := takeSessionIndex(index, key)
+	if err != nil {
+		return 0, err
+	}
+	for _, sessionID := range sessionIDs {
+		if err = DeleteSession(sessionID); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessionIDs), nil
+}
+
 func Set(subCache, key string, value any, ttl time.Duration) error {
 	return errors.WithStack(fedcache.Set(fedcache.Key(subCache, key), value, ttl))
 }
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runWithTestConfig(m))
+}
+
+func runWithTestConfig(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "offa-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	data := fmt.Sprintf("federation:\n  entity_id: https://offa.example.com\n  key_storage: %s\n", dir)
+	if err = os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(data), 0600); err != nil {
+		panic(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	config.MustLoadConfig()
+	if err = os.Chdir(wd); err != nil {
+		panic(err)
+	}
+	return m.Run()
+}
+
+func TestSessionIndexConcurrentAdd(t *testing.T) {
+	const n = 100
+	claims := model.UserClaims{
+		"iss": "https://op.example.org",
+		"sub": "concurrent",
+	}
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := indexSession(fmt.Sprintf("session-%d", i), claims); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	sessionIDs, err := takeSessionIndex(KeySessionIndexSub, SessionIndexKey("https://op.example.org", "concurrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessionIDs) != n {
+		t.Errorf("expected %d indexed sessions, got %d", n, len(sessionIDs))
+	}
+}
+
+func TestUnindexSession(t *testing.T) {
+	claims := model.UserClaims{
+		"iss": "https://op.example.org",
+		"sub": "user",
+		"sid": "sid",
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := indexSession(id, claims); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := UnindexSession("a", claims); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []struct {
+		name string
+		key  string
+	}{
+		{KeySessionIndexSub, SessionIndexKey("https://op.example.org", "user")},
+		{KeySessionIndexSID, SessionIndexKey("https://op.example.org", "sid")},
+	} {
+		sessionIDs, err := takeSessionIndex(index.name, index.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(sessionIDs, []string{"b"}) {
+			t.Errorf("expected only session b in %s, got %v", index.name, sessionIDs)
+		}
+		if sessionIDs, _ = takeSessionIndex(index.name, index.key); len(sessionIDs) != 0 {
+			t.Errorf("expected %s entry to be deleted, got %v", index.name, sessionIDs)
+		}
+	}
+}
@@ -4,14 +4,20 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strings"
 
 	"github.com/go-oidfed/lib"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 
+	"github.com/go-oidfed/offa/internal/expr"
 	"github.com/go-oidfed/offa/internal/model"
+	"github.com/go-oidfed/offa/internal/tmpl"
 )
 
 var conf *Config
@@ -26,7 +32,9 @@ type Config struct {
 	Server         serverConf     `yaml:"server"`
 	Logging        loggingConf    `yaml:"logging"`
 	Federation     federationConf `yaml:"federation"`
+	Policies       policiesConf   `yaml:"policies"`
 	Auth           authConf       `yaml:"auth"`
+	AuthMatching   string         `yaml:"auth_matching"`
 	SessionStorage sessionConf    `yaml:"sessions"`
 	DebugAuth      bool           `yaml:"debug_auth"`
 }
@@ -54,22 +62,113 @@ type federationConf struct {
 
 	KeyStorage                  string                                       `yaml:"key_storage"`
 	OnlyAutomaticOPs            bool                                         `yaml:"filter_to_automatic_ops"`
+	OPFilters                   opFiltersConf                                `yaml:"op_filters"`
 	TrustMarks                  []*oidfed.EntityConfigurationTrustMarkConfig `yaml:"trust_marks"`
 	UseResolveEndpoint          bool                                         `yaml:"use_resolve_endpoint"`
 	UseEntityCollectionEndpoint bool                                         `yaml:"use_entity_collection_endpoint"`
 	EntityCollectionInterval    int64                                        `yaml:"entity_collection_interval"`
+	OPCatalogFile               string                                       `yaml:"op_catalog_file"`
+	ClockSkew                   int64                                        `yaml:"clock_skew"`
+	Userinfo                    userinfoConf                                 `yaml:"userinfo"`
+}
+
+// opFiltersConf configures which of the collected OPs are offered on the
+// login page
+type opFiltersConf struct {
+	RequiredTrustMarks []string         `yaml:"required_trust_marks"`
+	SupportedScopes    []string         `yaml:"supported_scopes"`
+	SupportedClaims    []string         `yaml:"supported_claims"`
+	Intermediates      []string         `yaml:"intermediates"`
+	Allow              []string         `yaml:"allow"`
+	AllowRegex         []string         `yaml:"allow_regex"`
+	Deny               []string         `yaml:"deny"`
+	DenyRegex          []string         `yaml:"deny_regex"`
+	AllowRegexps       []*regexp.Regexp `yaml:"-"`
+	DenyRegexps        []*regexp.Regexp `yaml:"-"`
+}
+
+func (c *opFiltersConf) validate() error {
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid op filter regex '%s'", pattern)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	var err error
+	if c.AllowRegexps, err = compile(c.AllowRegex); err != nil {
+		return err
+	}
+	c.DenyRegexps, err = compile(c.DenyRegex)
+	return err
+}
+
+// Allows checks if an OP is allowed by the allow and deny lists. If allow
+// lists are given, the OP must match one of them; an OP matching a deny list
+// is never allowed.
+func (c *opFiltersConf) Allows(entityID string) bool {
+	matches := func(ids []string, res []*regexp.Regexp) bool {
+		return slices.Contains(ids, entityID) || slices.ContainsFunc(
+			res, func(re *regexp.Regexp) bool {
+				return re.MatchString(entityID)
+			},
+		)
+	}
+	if (len(c.Allow) > 0 || len(c.AllowRegexps) > 0) && !matches(c.Allow, c.AllowRegexps) {
+		return false
+	}
+	return !matches(c.Deny, c.DenyRegexps)
+}
+
+// Possible values for the userinfo precedence
+const (
+	UserinfoPrecedenceIDToken  = "id_token"
+	UserinfoPrecedenceUserinfo = "userinfo"
+)
+
+type userinfoConf struct {
+	Enabled    bool   `yaml:"enabled"`
+	Precedence string `yaml:"precedence"`
+}
+
+func (c *userinfoConf) validate() error {
+	switch c.Precedence {
+	case "":
+		c.Precedence = UserinfoPrecedenceIDToken
+	case UserinfoPrecedenceIDToken, UserinfoPrecedenceUserinfo:
+	default:
+		return errors.Errorf(
+			"invalid federation.userinfo.precedence '%s', must be one of '%s', '%s'", c.Precedence,
+			UserinfoPrecedenceIDToken, UserinfoPrecedenceUserinfo,
+		)
+	}
+	return nil
 }
 
 type sessionConf struct {
-	TTL             int                                               `yaml:"ttl"`
-	RedisAddr       string                                            `yaml:"redis_addr"`
-	MemCachedAddr   string                                            `yaml:"memcached_addr"`
-	MemCachedClaims map[string]oidfed.SliceOrSingleValue[model.Claim] `yaml:"memcached_claims"`
-	CookieName      string                                            `yaml:"cookie_name"`
-	CookieDomain    string                                            `yaml:"cookie_domain"`
+	TTL                  int                                               `yaml:"ttl"`
+	SlidingExpiration    bool                                              `yaml:"sliding_expiration"`
+	MaxLifetime          int                                               `yaml:"max_lifetime"`
+	RefreshTokens        bool                                              `yaml:"refresh_tokens"`
+	RevalidationInterval int                                               `yaml:"revalidation_interval"`
+	RedisAddr            string                                            `yaml:"redis_addr"`
+	MemCachedAddr        string                                            `yaml:"memcached_addr"`
+	MemCachedClaims      map[string]oidfed.SliceOrSingleValue[model.Claim] `yaml:"memcached_claims"`
+	CookieName           string                                            `yaml:"cookie_name"`
+	CookieDomain         string                                            `yaml:"cookie_domain"`
 }
 
 func (c sessionConf) validate() error {
+	if c.MaxLifetime < 0 {
+		return errors.Errorf("invalid sessions.max_lifetime %d, must not be negative", c.MaxLifetime)
+	}
+	if c.RevalidationInterval > 0 && !c.RefreshTokens {
+		return errors.New("sessions.revalidation_interval is set, but sessions.refresh_tokens is not enabled")
+	}
 	if c.MemCachedClaims != nil {
 		if _, set := c.MemCachedClaims["UserName"]; !set {
 			return errors.New("sessions.memcached_claims is set, but no claim for 'UserName' is set")
@@ -83,16 +182,125 @@ func (c sessionConf) validate() error {
 
 type authConf []*AuthRule
 
+// AuthPolicy is a named set of auth rule options that can be referenced by
+// multiple AuthRule
+type AuthPolicy struct {
+	Require              oidfed.SliceOrSingleValue[map[model.Claim]oidfed.SliceOrSingleValue[string]] `yaml:"require"`
+	RequireExpr          string                                                                       `yaml:"require_expr"`
+	ForwardHeaders       map[string]oidfed.SliceOrSingleValue[model.Claim]                            `yaml:"forward_headers"`
+	ForwardHeadersPrefix string                                                                       `yaml:"forward_headers_prefix"`
+	ForwardHeadersPreset string                                                                       `yaml:"forward_headers_preset"`
+	ForwardClaimsInclude []string                                                                     `yaml:"forward_claims_include"`
+	ForwardClaimsExclude []string                                                                     `yaml:"forward_claims_exclude"`
+	MaxHeaderSize        int                                                                          `yaml:"max_header_size"`
+	HeaderSizePolicy     string                                                                       `yaml:"header_size_policy"`
+	AllowedIssuers       []string                                                                     `yaml:"allowed_issuers"`
+	AllowedTrustAnchors  []string                                                                     `yaml:"allowed_trust_anchors"`
+	RequiredOPTrustMarks []string                                                                     `yaml:"required_op_trust_marks"`
+	RedirectStatusCode   int                                                                          `yaml:"redirect_status"`
+	Assertion            assertionConf                                                                `yaml:"assertion"`
+}
+
+type policiesConf map[string]*AuthPolicy
+
+// bearerConf configures the acceptance of bearer access tokens for an
+// AuthRule
+type bearerConf struct {
+	Enabled             bool     `yaml:"enabled"`
+	Issuers             []string `yaml:"issuers"`
+	Audiences           []string `yaml:"audiences"`
+	IntrospectionIssuer string   `yaml:"introspection_issuer"`
+}
+
+func (c *bearerConf) validate() error {
+	if c.IntrospectionIssuer != "" && len(c.Issuers) > 0 && !slices.Contains(c.Issuers, c.IntrospectionIssuer) {
+		return errors.Errorf("bearer introspection_issuer '%s' is not one of the issuers", c.IntrospectionIssuer)
+	}
+	return nil
+}
+
+// assertionConf configures the signed jwt assertion that is forwarded for
+// an AuthRule
+type assertionConf struct {
+	Enabled  bool          `yaml:"enabled"`
+	Header   string        `yaml:"header"`
+	Claims   []model.Claim `yaml:"claims"`
+	Lifetime int64         `yaml:"lifetime"`
+}
+
+// DefaultAssertionClaims are the user claims included in the assertion if
+// no claims are configured
+var DefaultAssertionClaims = []model.Claim{
+	"sub",
+	"preferred_username",
+	"email",
+	"name",
+	"groups",
+}
+
+func (c *assertionConf) validate() {
+	if c.Header == "" {
+		c.Header = "X-Offa-Assertion"
+	}
+	if c.Claims == nil {
+		c.Claims = DefaultAssertionClaims
+	}
+	if c.Lifetime == 0 {
+		c.Lifetime = 60
+	}
+}
+
+// Possible values for the header size policy of an AuthRule
+const (
+	HeaderSizePolicyTruncate = "truncate"
+	HeaderSizePolicyDrop     = "drop"
+	HeaderSizePolicyFail     = "fail"
+)
+
+// Possible values for the action of an AuthRule
+const (
+	AuthActionAllow = "allow"
+	AuthActionDeny  = "deny"
+)
+
+// Possible values for the auth matching mode
+const (
+	AuthMatchingFirst        = "first"
+	AuthMatchingMostSpecific = "most_specific"
+)
+
 type AuthRule struct {
+	Action               string                                                                       `yaml:"action"`
+	Anonymous            bool                                                                         `yaml:"anonymous"`
+	API                  bool                                                                         `yaml:"api"`
+	Bearer               bearerConf                                                                   `yaml:"bearer"`
+	Assertion            assertionConf                                                                `yaml:"assertion"`
+	Policy               string                                                                       `yaml:"policy"`
+	Policies             []string                                                                     `yaml:"policies"`
 	Domain               string                                                                       `yaml:"domain"`
 	DomainRegex          string                                                                       `yaml:"domain_regex"`
 	DomainPattern        *regexp.Regexp                                                               `yaml:"-"`
 	Path                 string                                                                       `yaml:"path"`
 	PathRegex            string                                                                       `yaml:"path_regex"`
 	PathPattern          *regexp.Regexp                                                               `yaml:"-"`
+	Methods              []string                                                                     `yaml:"methods"`
+	SourceCIDRs          []string                                                                     `yaml:"source_cidrs"`
+	SourceNets           []*net.IPNet                                                                 `yaml:"-"`
 	Require              oidfed.SliceOrSingleValue[map[model.Claim]oidfed.SliceOrSingleValue[string]] `yaml:"require"`
+	RequireExpr          string                                                                       `yaml:"require_expr"`
+	RequireProgram       *expr.Program                                                                `yaml:"-"`
 	ForwardHeaders       map[string]oidfed.SliceOrSingleValue[model.Claim]                            `yaml:"forward_headers"`
 	ForwardHeadersPrefix string                                                                       `yaml:"forward_headers_prefix"`
+	ForwardHeadersPreset string                                                                       `yaml:"forward_headers_preset"`
+	HeaderTemplates      map[string]string                                                            `yaml:"forward_header_templates"`
+	HeaderTemplatesTmpl  map[string]*tmpl.Template                                                    `yaml:"-"`
+	ForwardClaimsInclude []string                                                                     `yaml:"forward_claims_include"`
+	ForwardClaimsExclude []string                                                                     `yaml:"forward_claims_exclude"`
+	MaxHeaderSize        int                                                                          `yaml:"max_header_size"`
+	HeaderSizePolicy     string                                                                       `yaml:"header_size_policy"`
+	AllowedIssuers       []string                                                                     `yaml:"allowed_issuers"`
+	AllowedTrustAnchors  []string                                                                     `yaml:"allowed_trust_anchors"`
+	RequiredOPTrustMarks []string                                                                     `yaml:"required_op_trust_marks"`
 	RedirectStatusCode   int                                                                          `yaml:"redirect_status"`
 }
 
@@ -110,6 +318,44 @@ var DefaultForwardHeaders = map[string]oidfed.SliceOrSingleValue[model.Claim]{
 	},
 	"X-Forwarded-Name": {"name"},
 }
+
+// Possible values for the forward headers preset of an AuthRule
+const (
+	ForwardHeadersPresetOFFA           = "offa"
+	ForwardHeadersPresetOAuth2Proxy    = "oauth2-proxy"
+	ForwardHeadersPresetModAuthOpenIDC = "mod_auth_openidc"
+	ForwardHeadersPresetAuthelia       = "authelia"
+	ForwardHeadersPresetBasic          = "basic"
+)
+
+// ForwardHeadersPresets holds the header mappings of the forward headers
+// presets that can be expressed as such; the mod_auth_openidc and basic
+// presets need a special encoding and are handled by the server
+var ForwardHeadersPresets = map[string]map[string]oidfed.SliceOrSingleValue[model.Claim]{
+	ForwardHeadersPresetOFFA: DefaultForwardHeaders,
+	ForwardHeadersPresetOAuth2Proxy: {
+		"X-Auth-Request-User":               {"sub"},
+		"X-Auth-Request-Email":              {"email"},
+		"X-Auth-Request-Preferred-Username": {"preferred_username"},
+		"X-Auth-Request-Groups": {
+			"groups",
+			"entitlements",
+		},
+	},
+	ForwardHeadersPresetAuthelia: {
+		"Remote-User": {
+			"preferred_username",
+			"sub",
+		},
+		"Remote-Groups": {
+			"groups",
+			"entitlements",
+		},
+		"Remote-Email": {"email"},
+		"Remote-Name":  {"name"},
+	},
+}
+
 var DefaultMemCachedClaims = map[string]oidfed.SliceOrSingleValue[model.Claim]{
 	"UserName": {
 		"preferred_username",
@@ -124,60 +370,745 @@ var DefaultMemCachedClaims = map[string]oidfed.SliceOrSingleValue[model.Claim]{
 }
 
 func (r *AuthRule) validate() error {
+	switch r.Action {
+	case "":
+		r.Action = AuthActionAllow
+	case AuthActionAllow, AuthActionDeny:
+	default:
+		return errors.Errorf(
+			"invalid action '%s' for auth rule, must be one of '%s', '%s'", r.Action, AuthActionAllow,
+			AuthActionDeny,
+		)
+	}
+	switch r.ForwardHeadersPreset {
+	case "", ForwardHeadersPresetModAuthOpenIDC, ForwardHeadersPresetBasic:
+	default:
+		if _, ok := ForwardHeadersPresets[r.ForwardHeadersPreset]; !ok {
+			return errors.Errorf("unknown forward_headers_preset '%s'", r.ForwardHeadersPreset)
+		}
+	}
 	if r.Domain != "" {
-		r.DomainRegex = regexp.QuoteMeta(r.Domain)
+		r.DomainRegex = "^" + regexp.QuoteMeta(r.Domain) + "$"
 	}
 	if r.Path != "" {
-		r.PathRegex = regexp.QuoteMeta(r.Path)
+		r.PathRegex = "^" + regexp.QuoteMeta(r.Path) + "$"
 	}
-	if r.Domain == "" {
+	if r.DomainRegex == "" {
 		return errors.New("domain or domain_regex is required")
 	}
-	r.DomainPattern = regexp.MustCompile(r.DomainRegex)
+	var err error
+	r.DomainPattern, err = regexp.Compile(r.DomainRegex)
+	if err != nil {
+		return errors.Wrapf(err, "invalid domain_regex '%s'", r.DomainRegex)
+	}
 	if r.PathRegex != "" {
-		r.PathPattern = regexp.MustCompile(r.PathRegex)
+		r.PathPattern, err = regexp.Compile(r.PathRegex)
+		if err != nil {
+			return errors.Wrapf(err, "invalid path_regex '%s'", r.PathRegex)
+		}
+	}
+	if err = r.validatePlaceholders(); err != nil {
+		return err
+	}
+	if r.RequireExpr != "" {
+		prg, err := expr.Compile(r.RequireExpr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid require_expr for domain '%s'", r.DomainRegex)
+		}
+		r.RequireProgram = prg
+	}
+	r.Assertion.validate()
+	if err = r.Bearer.validate(); err != nil {
+		return errors.Wrapf(err, "invalid auth rule for domain '%s'", r.DomainRegex)
+	}
+	for _, pattern := range slices.Concat(r.ForwardClaimsInclude, r.ForwardClaimsExclude) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid claim pattern '%s' for domain '%s'", pattern, r.DomainRegex)
+		}
+	}
+	if r.MaxHeaderSize < 0 {
+		return errors.Errorf("invalid max_header_size %d, must not be negative", r.MaxHeaderSize)
+	}
+	switch r.HeaderSizePolicy {
+	case "":
+		r.HeaderSizePolicy = HeaderSizePolicyDrop
+	case HeaderSizePolicyTruncate, HeaderSizePolicyDrop, HeaderSizePolicyFail:
+	default:
+		return errors.Errorf(
+			"invalid header_size_policy '%s', must be one of '%s', '%s', '%s'", r.HeaderSizePolicy,
+			HeaderSizePolicyTruncate, HeaderSizePolicyDrop, HeaderSizePolicyFail,
+		)
+	}
+	r.HeaderTemplatesTmpl = make(map[string]*tmpl.Template, len(r.HeaderTemplates))
+	for header, source := range r.HeaderTemplates {
+		t, err := tmpl.Compile(header, source)
+		if err != nil {
+			return errors.Wrapf(err, "invalid template for header '%s' for domain '%s'", header, r.DomainRegex)
+		}
+		for _, name := range t.CaptureNames() {
+			if !slices.Contains(r.captureNames(), name) {
+				return errors.Errorf(
+					"template for header '%s' in auth rule for domain '%s' references '.captures.%s', "+
+						"which is not a named capture group", header, r.DomainRegex, name,
+				)
+			}
+		}
+		r.HeaderTemplatesTmpl[header] = t
+	}
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(m)
+	}
+	for _, cidr := range r.SourceCIDRs {
+		ipNet, err := parseCIDROrIP(cidr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid source_cidrs entry for domain '%s'", r.DomainRegex)
+		}
+		r.SourceNets = append(r.SourceNets, ipNet)
+	}
+	return nil
+}
+
+// parseCIDROrIP parses a CIDR; a single ip address is treated as a network
+// containing only this address
+func parseCIDROrIP(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.Errorf("invalid ip address '%s'", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits, bits),
+		}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, errors.WithStack(err)
+}
+
+// captureNames returns the names of all named capture groups of the
+// domain and path regexes
+func (r *AuthRule) captureNames() []string {
+	names := r.DomainPattern.SubexpNames()
+	if r.PathPattern != nil {
+		names = append(names, r.PathPattern.SubexpNames()...)
+	}
+	return names
+}
+
+// validatePlaceholders checks that all placeholders used in require values
+// and forward_headers reference a named capture group
+func (r *AuthRule) validatePlaceholders() error {
+	names := r.captureNames()
+	check := func(value string) error {
+		for _, name := range PlaceholderNames(value) {
+			if !slices.Contains(names, name) {
+				return errors.Errorf(
+					"placeholder '{%s}' in auth rule for domain '%s' does not reference a named capture group",
+					name, r.DomainRegex,
+				)
+			}
+		}
+		return nil
+	}
+	for _, option := range r.Require {
+		for _, values := range option {
+			for _, v := range values {
+				if err := check(v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, claims := range r.ForwardHeaders {
+		for _, cl := range claims {
+			if err := check(string(cl)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ForwardsClaim checks if a claim should be forwarded in the prefixed
+// all-claims mode according to the include and exclude patterns
+func (r *AuthRule) ForwardsClaim(claim model.Claim) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, string(claim)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(r.ForwardClaimsInclude) > 0 && !matches(r.ForwardClaimsInclude) {
+		return false
+	}
+	return !matches(r.ForwardClaimsExclude)
+}
+
+// RestrictsOPs checks if the AuthRule only accepts users from some OPs
+func (r *AuthRule) RestrictsOPs() bool {
+	return len(r.AllowedIssuers) > 0 || len(r.AllowedTrustAnchors) > 0 || len(r.RequiredOPTrustMarks) > 0
+}
+
+// match checks if the AuthRule matches the passed request attributes and
+// returns the values of the named capture groups; the host is matched
+// without port and the path without query and fragment
+func (r *AuthRule) match(host, uri, method, clientIP string) (Captures, bool) {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, strings.ToUpper(method)) {
+		return nil, false
+	}
+	if len(r.SourceNets) > 0 && !ipInNets(clientIP, r.SourceNets) {
+		return nil, false
+	}
+	domainMatch := r.DomainPattern.FindStringSubmatch(hostWithoutPort(host))
+	if domainMatch == nil {
+		return nil, false
+	}
+	captures := Captures{}
+	captures.add(r.DomainPattern, domainMatch)
+	if r.PathPattern != nil {
+		pathMatch := r.PathPattern.FindStringSubmatch(requestPath(uri))
+		if pathMatch == nil {
+			return nil, false
+		}
+		captures.add(r.PathPattern, pathMatch)
+	}
+	return captures, true
+}
+
+// hostWithoutPort removes the port from the passed host, since proxies
+// might include it in the forwarded host
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// requestPath returns the decoded path component of the passed request uri.
+// Query and fragment are removed, since otherwise a rule for an exact path
+// could be bypassed by appending e.g. '?'. url.ParseRequestURI is used
+// instead of url.Parse, so that a path starting with '//' is not parsed as
+// host.
+func requestPath(uri string) string {
+	uri, _, _ = strings.Cut(uri, "#")
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		return u.Path
+	}
+	p, _, _ := strings.Cut(uri, "?")
+	return p
+}
+
+// ipInNets checks if the passed ip is contained in any of the passed
+// networks
+func ipInNets(ipStr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Captures holds the values of the named capture groups of an AuthRule's
+// domain and path regexes for a request
+type Captures map[string]string
+
+func (c Captures) add(pattern *regexp.Regexp, match []string) {
+	for i, name := range pattern.SubexpNames() {
+		if name != "" && i < len(match) {
+			c[name] = match[i]
+		}
+	}
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// PlaceholderNames returns the names of all '{name}' placeholders in the
+// passed string
+func PlaceholderNames(s string) (names []string) {
+	for _, m := range placeholderPattern.FindAllStringSubmatch(s, -1) {
+		names = append(names, m[1])
+	}
+	return
+}
+
+// Expand replaces all '{name}' placeholders in the passed string with the
+// captured values
+func (c Captures) Expand(s string) string {
+	return placeholderPattern.ReplaceAllStringFunc(
+		s, func(p string) string {
+			return c[p[1:len(p)-1]]
+		},
+	)
+}
+
+// combine combines the passed AuthPolicy into this one. Both requirements
+// must be fulfilled, i.e. the require options are combined with a logical
+// AND, as are the require expressions. For the other options the values
+// of the passed policy take precedence.
+func (p *AuthPolicy) combine(other *AuthPolicy) {
+	switch {
+	case len(other.Require) == 0:
+	case len(p.Require) == 0:
+		p.Require = other.Require
+	default:
+		var combined oidfed.SliceOrSingleValue[map[model.Claim]oidfed.SliceOrSingleValue[string]]
+		for _, a := range p.Require {
+			for _, b := range other.Require {
+				option := make(map[model.Claim]oidfed.SliceOrSingleValue[string], len(a)+len(b))
+				for claim, values := range a {
+					option[claim] = slices.Clone(values)
+				}
+				for claim, values := range b {
+					for _, v := range values {
+						if !slices.Contains(option[claim], v) {
+							option[claim] = append(option[claim], v)
+						}
+					}
+				}
+				combined = append(combined, option)
+			}
+		}
+		p.Require = combined
+	}
+	switch {
+	case other.RequireExpr == "":
+	case p.RequireExpr == "":
+		p.RequireExpr = other.RequireExpr
+	default:
+		p.RequireExpr = "(" + p.RequireExpr + ") && (" + other.RequireExpr + ")"
+	}
+	if other.ForwardHeaders != nil {
+		if p.ForwardHeaders == nil {
+			p.ForwardHeaders = make(map[string]oidfed.SliceOrSingleValue[model.Claim], len(other.ForwardHeaders))
+		}
+		for header, claims := range other.ForwardHeaders {
+			p.ForwardHeaders[header] = claims
+		}
+	}
+	if other.ForwardHeadersPrefix != "" {
+		p.ForwardHeadersPrefix = other.ForwardHeadersPrefix
+	}
+	if other.ForwardHeadersPreset != "" {
+		p.ForwardHeadersPreset = other.ForwardHeadersPreset
+	}
+	if other.ForwardClaimsInclude != nil {
+		p.ForwardClaimsInclude = other.ForwardClaimsInclude
+	}
+	if other.ForwardClaimsExclude != nil {
+		p.ForwardClaimsExclude = other.ForwardClaimsExclude
+	}
+	if other.MaxHeaderSize != 0 {
+		p.MaxHeaderSize = other.MaxHeaderSize
+	}
+	if other.HeaderSizePolicy != "" {
+		p.HeaderSizePolicy = other.HeaderSizePolicy
+	}
+	if other.AllowedIssuers != nil {
+		p.AllowedIssuers = other.AllowedIssuers
+	}
+	if other.AllowedTrustAnchors != nil {
+		p.AllowedTrustAnchors = other.AllowedTrustAnchors
+	}
+	if other.RequiredOPTrustMarks != nil {
+		p.RequiredOPTrustMarks = other.RequiredOPTrustMarks
+	}
+	if other.RedirectStatusCode != 0 {
+		p.RedirectStatusCode = other.RedirectStatusCode
+	}
+	if other.Assertion.Enabled {
+		p.Assertion = other.Assertion
+	}
+}
+
+// applyPolicies applies the policies referenced by the AuthRule. Options
+// that are set in the AuthRule itself override the values from the
+// policies.
+func (r *AuthRule) applyPolicies(policies policiesConf) error {
+	names := r.Policies
+	if r.Policy != "" {
+		names = append([]string{r.Policy}, names...)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	effective := &AuthPolicy{}
+	for _, name := range names {
+		p, ok := policies[name]
+		if !ok || p == nil {
+			domain := r.Domain
+			if domain == "" {
+				domain = r.DomainRegex
+			}
+			return errors.Errorf("auth rule for domain '%s' references unknown policy '%s'", domain, name)
+		}
+		effective.combine(p)
+	}
+	if len(r.Require) == 0 {
+		r.Require = effective.Require
+	}
+	if r.RequireExpr == "" {
+		r.RequireExpr = effective.RequireExpr
+	}
+	if r.ForwardHeaders == nil {
+		r.ForwardHeaders = effective.ForwardHeaders
+	}
+	if r.ForwardHeadersPrefix == "" {
+		r.ForwardHeadersPrefix = effective.ForwardHeadersPrefix
+	}
+	if r.ForwardHeadersPreset == "" {
+		r.ForwardHeadersPreset = effective.ForwardHeadersPreset
+	}
+	if r.ForwardClaimsInclude == nil {
+		r.ForwardClaimsInclude = effective.ForwardClaimsInclude
+	}
+	if r.ForwardClaimsExclude == nil {
+		r.ForwardClaimsExclude = effective.ForwardClaimsExclude
+	}
+	if r.MaxHeaderSize == 0 {
+		r.MaxHeaderSize = effective.MaxHeaderSize
+	}
+	if r.HeaderSizePolicy == "" {
+		r.HeaderSizePolicy = effective.HeaderSizePolicy
+	}
+	if r.AllowedIssuers == nil {
+		r.AllowedIssuers = effective.AllowedIssuers
+	}
+	if r.AllowedTrustAnchors == nil {
+		r.AllowedTrustAnchors = effective.AllowedTrustAnchors
+	}
+	if r.RequiredOPTrustMarks == nil {
+		r.RequiredOPTrustMarks = effective.RequiredOPTrustMarks
+	}
+	if r.RedirectStatusCode == 0 {
+		r.RedirectStatusCode = effective.RedirectStatusCode
+	}
+	if !r.Assertion.Enabled {
+		r.Assertion = effective.Assertion
 	}
 	return nil
 }
 
-func (c *authConf) validate() error {
+func (c *authConf) validate(policies policiesConf, matching string) error {
 	for i, rule := range *c {
+		if err := rule.applyPolicies(policies); err != nil {
+			return err
+		}
 		if err := rule.validate(); err != nil {
 			return err
 		}
 		(*c)[i] = rule
 	}
+	switch matching {
+	case "", AuthMatchingFirst:
+	case AuthMatchingMostSpecific:
+		// The specificity of a rule does not depend on the request, so
+		// ordering the rules by it lets FindRule return the most specific
+		// match
+		slices.SortStableFunc(
+			*c, func(a, b *AuthRule) int {
+				return b.specificity().compare(a.specificity())
+			},
+		)
+	default:
+		return errors.Errorf(
+			"invalid auth_matching '%s', must be one of '%s', '%s'", matching, AuthMatchingFirst,
+			AuthMatchingMostSpecific,
+		)
+	}
+	c.warnShadowedRules()
 	return nil
 }
 
-func (c authConf) FindRule(host, path string) *AuthRule {
-	for _, rule := range c {
-		if rule.DomainPattern.MatchString(host) {
-			if rule.PathPattern == nil {
-				return rule
-			}
-			if rule.PathPattern.MatchString(path) {
-				return rule
+// ruleSpecificity describes how specific an AuthRule is; an exact domain is
+// more specific than a domain regex, a longer path prefix more specific than
+// a shorter one, and for the same prefix an exact path is more specific than
+// a path regex; finally rules with method or source ip conditions are more
+// specific than rules without
+type ruleSpecificity struct {
+	exactDomain   bool
+	pathPrefixLen int
+	exactPath     bool
+	conditions    int
+}
+
+func (s ruleSpecificity) compare(o ruleSpecificity) int {
+	if s.exactDomain != o.exactDomain {
+		if s.exactDomain {
+			return 1
+		}
+		return -1
+	}
+	if s.pathPrefixLen != o.pathPrefixLen {
+		return s.pathPrefixLen - o.pathPrefixLen
+	}
+	if s.exactPath != o.exactPath {
+		if s.exactPath {
+			return 1
+		}
+		return -1
+	}
+	return s.conditions - o.conditions
+}
+
+func (r *AuthRule) specificity() ruleSpecificity {
+	s := ruleSpecificity{
+		exactDomain: r.Domain != "",
+		exactPath:   r.Path != "",
+	}
+	if len(r.Methods) > 0 {
+		s.conditions++
+	}
+	if len(r.SourceNets) > 0 {
+		s.conditions++
+	}
+	if r.Path != "" {
+		s.pathPrefixLen = len(r.Path)
+	} else if r.PathRegex != "" {
+		s.pathPrefixLen = len(literalPrefix(r.PathRegex))
+	}
+	return s
+}
+
+// literalPrefix returns the literal string an anchored or unanchored regex
+// starts with
+func literalPrefix(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	var prefix strings.Builder
+	for _, sub := range subs {
+		switch {
+		case sub.Op == syntax.OpBeginText || sub.Op == syntax.OpBeginLine:
+		case sub.Op == syntax.OpLiteral && sub.Flags&syntax.FoldCase == 0:
+			prefix.WriteString(string(sub.Rune))
+		default:
+			return prefix.String()
+		}
+	}
+	return prefix.String()
+}
+
+// shadows checks if this AuthRule matches all requests matched by the other
+// rule, so that the other rule can never be reached if it comes later. The
+// check is conservative, i.e. it might miss some shadowed rules.
+func (r *AuthRule) shadows(other *AuthRule) bool {
+	domainCovered := r.DomainRegex == other.DomainRegex ||
+		(other.Domain != "" && r.DomainPattern.MatchString(other.Domain))
+	if !domainCovered {
+		return false
+	}
+	if len(r.Methods) > 0 && (len(other.Methods) == 0 || !IsSubset(other.Methods, r.Methods)) {
+		return false
+	}
+	if len(r.SourceCIDRs) > 0 && !slices.Equal(r.SourceCIDRs, other.SourceCIDRs) {
+		return false
+	}
+	if r.PathPattern == nil {
+		return true
+	}
+	return r.PathRegex == other.PathRegex ||
+		(other.Path != "" && r.PathPattern.MatchString(other.Path))
+}
+
+// IsSubset checks if all elements of sub are contained in super
+func IsSubset(sub, super []string) bool {
+	for _, e := range sub {
+		if !slices.Contains(super, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// warnShadowedRules logs a warning for each AuthRule that cannot be reached
+// because an earlier rule already matches all its requests
+func (c authConf) warnShadowedRules() {
+	for i, rule := range c {
+		for _, earlier := range c[:i] {
+			if earlier.shadows(rule) {
+				log.WithFields(
+					log.Fields{
+						"domain":             rule.DomainRegex,
+						"path":               rule.PathRegex,
+						"shadowed_by_domain": earlier.DomainRegex,
+						"shadowed_by_path":   earlier.PathRegex,
+					},
+				).Warn("Auth rule is unreachable, because it is shadowed by an earlier rule")
+				break
 			}
 		}
 	}
-	return nil
+}
+
+// warnMethodRules logs a warning for each AuthRule with methods; it is
+// called if no header for the original method is configured, since such
+// rules then never match and requests fall through to later rules
+func (c authConf) warnMethodRules() {
+	for _, rule := range c {
+		if len(rule.Methods) > 0 {
+			log.WithFields(
+				log.Fields{
+					"domain":  rule.DomainRegex,
+					"path":    rule.PathRegex,
+					"methods": rule.Methods,
+				},
+			).Warn(
+				"Auth rule with methods never matches forward auth requests, because no " +
+					"server.forwarded_headers.method is configured",
+			)
+		}
+	}
+}
+
+// FindRule returns the first AuthRule that matches the passed request
+// attributes together with the values of the rule's named capture groups;
+// uri is the request uri as forwarded by the proxy, possibly including a
+// query
+func (c authConf) FindRule(host, uri, method, clientIP string) (*AuthRule, Captures) {
+	for _, rule := range c {
+		if captures, ok := rule.match(host, uri, method, clientIP); ok {
+			return rule, captures
+		}
+	}
+	return nil, nil
+}
+
+// MatchesDomain checks if the passed host is fully matched by the domain of
+// any of the AuthRule
+func (c authConf) MatchesDomain(host string) bool {
+	for _, rule := range c {
+		if host != "" && rule.DomainPattern.FindString(host) == host {
+			return true
+		}
+	}
+	return false
 }
 
 type serverConf struct {
-	Port            int          `yaml:"port"`
-	TLS             tlsConf      `yaml:"tls"`
-	TrustedProxies  []string     `yaml:"trusted_proxies"`
-	TrustedNets     []*net.IPNet `yaml:"-"`
-	Paths           pathConf     `yaml:"paths"`
-	Secure          bool         `yaml:"-"`
-	Basepath        string       `yaml:"-"`
-	WebOverwriteDir string       `yaml:"web_overwrite_dir"`
+	Port             int                  `yaml:"port"`
+	TLS              tlsConf              `yaml:"tls"`
+	TrustedProxies   []string             `yaml:"trusted_proxies"`
+	TrustedNets      []*net.IPNet         `yaml:"-"`
+	Paths            pathConf             `yaml:"paths"`
+	ExtAuthz         extAuthzConf         `yaml:"ext_authz"`
+	ForwardedHeaders forwardedHeadersConf `yaml:"forwarded_headers"`
+	AdminToken       string               `yaml:"admin_token"`
+	Secure           bool                 `yaml:"-"`
+	Basepath         string               `yaml:"-"`
+	WebOverwriteDir  string               `yaml:"web_overwrite_dir"`
 }
 
 type pathConf struct {
-	Login       string `yaml:"login"`
-	ForwardAuth string `yaml:"forward_auth"`
+	Login             string `yaml:"login"`
+	Logout            string `yaml:"logout"`
+	BackchannelLogout string `yaml:"backchannel_logout"`
+	ForwardAuth       string `yaml:"forward_auth"`
+	ExtAuthz          string `yaml:"ext_authz"`
+	Admin             string `yaml:"admin"`
+	OPsAPI            string `yaml:"ops_api"`
+}
+
+// forwardedHeadersConf defines from which request headers the attributes of
+// the original request are obtained at the forward auth endpoint
+type forwardedHeadersConf struct {
+	Preset   string `yaml:"preset"`
+	URL      string `yaml:"url"`
+	Host     string `yaml:"host"`
+	URI      string `yaml:"uri"`
+	Method   string `yaml:"method"`
+	Proto    string `yaml:"proto"`
+	ClientIP string `yaml:"client_ip"`
+}
+
+// Possible presets for the forwarded headers
+const (
+	ForwardedHeadersPresetTraefik = "traefik"
+	ForwardedHeadersPresetCaddy   = "caddy"
+	ForwardedHeadersPresetNginx   = "nginx"
+	ForwardedHeadersPresetHAProxy = "haproxy"
+	ForwardedHeadersPresetCustom  = "custom"
+)
+
+var forwardedHeadersPresets = map[string]forwardedHeadersConf{
+	ForwardedHeadersPresetTraefik: {
+		Host:     "X-Forwarded-Host",
+		URI:      "X-Forwarded-Uri",
+		Method:   "X-Forwarded-Method",
+		Proto:    "X-Forwarded-Proto",
+		ClientIP: "X-Forwarded-For",
+	},
+	ForwardedHeadersPresetCaddy: {
+		Host:     "X-Forwarded-Host",
+		URI:      "X-Forwarded-Uri",
+		Method:   "X-Forwarded-Method",
+		Proto:    "X-Forwarded-Proto",
+		ClientIP: "X-Forwarded-For",
+	},
+	ForwardedHeadersPresetNginx: {
+		URL:      "X-Original-URL",
+		Host:     "X-Forwarded-Host",
+		URI:      "X-Original-URI",
+		Method:   "X-Original-Method",
+		Proto:    "X-Forwarded-Proto",
+		ClientIP: "X-Real-IP",
+	},
+	ForwardedHeadersPresetHAProxy: {
+		Host:     "X-Forwarded-Host",
+		URI:      "X-Original-URI",
+		Method:   "X-Original-Method",
+		Proto:    "X-Forwarded-Proto",
+		ClientIP: "X-Forwarded-For",
+	},
+	ForwardedHeadersPresetCustom: {},
+}
+
+// validate applies the preset; headers that are set explicitly take
+// precedence over the preset
+func (c *forwardedHeadersConf) validate() error {
+	if c.Preset == "" {
+		c.Preset = ForwardedHeadersPresetTraefik
+	}
+	preset, ok := forwardedHeadersPresets[c.Preset]
+	if !ok {
+		return errors.Errorf("unknown server.forwarded_headers.preset '%s'", c.Preset)
+	}
+	setIfEmpty := func(value *string, presetValue string) {
+		if *value == "" {
+			*value = presetValue
+		}
+	}
+	setIfEmpty(&c.URL, preset.URL)
+	setIfEmpty(&c.Host, preset.Host)
+	setIfEmpty(&c.URI, preset.URI)
+	setIfEmpty(&c.Method, preset.Method)
+	setIfEmpty(&c.Proto, preset.Proto)
+	setIfEmpty(&c.ClientIP, preset.ClientIP)
+	if c.URL == "" && (c.Host == "" || c.URI == "") {
+		return errors.New("server.forwarded_headers must define the url header or the host and uri headers")
+	}
+	return nil
+}
+
+type extAuthzConf struct {
+	GRPCPort int `yaml:"grpc_port"`
 }
 
 type tlsConf struct {
@@ -217,8 +1148,11 @@ func checkLoggingDirExists(dir string) error {
 }
 
 func (c *serverConf) validate() error {
+	if err := c.ForwardedHeaders.validate(); err != nil {
+		return err
+	}
 	for _, cidr := range c.TrustedProxies {
-		_, ipnet, err := net.ParseCIDR(cidr)
+		ipnet, err := parseCIDROrIP(cidr)
 		if err != nil {
 			return errors.Wrapf(err, "invalid trusted proxy CIDR '%s'", cidr)
 		}
@@ -266,12 +1200,27 @@ func validate() error {
 	if err := conf.Server.validate(); err != nil {
 		return err
 	}
-	if err := conf.Auth.validate(); err != nil {
+	if err := conf.Auth.validate(conf.Policies, conf.AuthMatching); err != nil {
 		return err
 	}
+	if conf.Server.ForwardedHeaders.Method == "" {
+		conf.Auth.warnMethodRules()
+	}
 	if err := conf.SessionStorage.validate(); err != nil {
 		return err
 	}
+	if conf.Federation.EntityCollectionInterval <= 0 {
+		return errors.Errorf(
+			"invalid federation.entity_collection_interval %d, must be positive",
+			conf.Federation.EntityCollectionInterval,
+		)
+	}
+	if err := conf.Federation.OPFilters.validate(); err != nil {
+		return err
+	}
+	if err := conf.Federation.Userinfo.validate(); err != nil {
+		return err
+	}
 	u, err := url.Parse(conf.Federation.EntityID)
 	if err != nil {
 		return err
@@ -295,8 +1244,13 @@ func MustLoadConfig() {
 		Server: serverConf{
 			Port: 15661,
 			Paths: pathConf{
-				Login:       "/login",
-				ForwardAuth: "/auth",
+				Login:             "/login",
+				Logout:            "/logout",
+				BackchannelLogout: "/backchannel-logout",
+				ForwardAuth:       "/auth",
+				ExtAuthz:          "/ext-authz",
+				Admin:             "/admin",
+				OPsAPI:            "/api/ops",
 			},
 		},
 		SessionStorage: sessionConf{
@@ -305,6 +1259,7 @@ func MustLoadConfig() {
 		},
 		Federation: federationConf{
 			EntityCollectionInterval: 5,
+			ClockSkew:                60,
 		},
 	}
 	if err := yaml.Unmarshal(data, conf); err != nil {
@@ -332,6 +1287,9 @@ func MustLoadConfig() {
 	if !d.IsDir() {
 		log.Fatalf("key_storage '%s' must be a directory", conf.Federation.KeyStorage)
 	}
+	if conf.Federation.OPCatalogFile == "" {
+		conf.Federation.OPCatalogFile = path.Join(conf.Federation.KeyStorage, "op_catalog.json")
+	}
 	if err = validate(); err != nil {
 		log.Fatalf("%s", err)
 	}
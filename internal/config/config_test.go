@@ -0,0 +1,535 @@
+package config
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-oidfed/lib"
+
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func TestAuthRuleValidateHeaderTemplates(t *testing.T) {
+	tests := []struct {
+		name        string
+		domainRegex string
+		templates   map[string]string
+		errContains string
+	}{
+		{
+			name:        "known capture",
+			domainRegex: `^(?P<tenant>[a-z]+)\.example\.com$`,
+			templates:   map[string]string{"X-Tenant": "{{.captures.tenant}}"},
+		},
+		{
+			name:        "unknown capture",
+			domainRegex: `^(?P<tenant>[a-z]+)\.example\.com$`,
+			templates:   map[string]string{"X-Tenant": "{{.captures.org}}"},
+			errContains: "'.captures.org'",
+		},
+		{
+			name:        "invalid template",
+			domainRegex: `^example\.com$`,
+			templates:   map[string]string{"X-Name": "{{.name"},
+			errContains: "invalid template for header 'X-Name'",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				rule := &AuthRule{
+					DomainRegex:     test.domainRegex,
+					HeaderTemplates: test.templates,
+				}
+				err := rule.validate()
+				if test.errContains == "" {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), test.errContains) {
+					t.Fatalf("expected error containing %q, got %v", test.errContains, err)
+				}
+			},
+		)
+	}
+}
+
+func TestValidateEntityCollectionInterval(t *testing.T) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	for _, interval := range []int64{-1, 0, 5} {
+		conf = &Config{
+			Federation: federationConf{
+				EntityID:                 "https://offa.example.com",
+				EntityCollectionInterval: interval,
+			},
+		}
+		err := validate()
+		if interval > 0 && err != nil {
+			t.Errorf("unexpected error for interval %d: %v", interval, err)
+		}
+		if interval <= 0 && (err == nil || !strings.Contains(err.Error(), "entity_collection_interval")) {
+			t.Errorf("expected entity_collection_interval error for interval %d, got %v", interval, err)
+		}
+	}
+}
+
+func mustValidateRules(t *testing.T, matching string, rules ...*AuthRule) authConf {
+	t.Helper()
+	c := authConf(slices.Clone(rules))
+	if err := c.validate(nil, matching); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c
+}
+
+func TestFindRule(t *testing.T) {
+	newRules := func() []*AuthRule {
+		return []*AuthRule{
+			{Domain: "example.com", PathRegex: "^/"},
+			{Domain: "example.com", Path: "/admin", Action: AuthActionDeny},
+			{DomainRegex: `^[a-z]+\.example\.com$`},
+			{Domain: "example.com", PathRegex: "^/admin", Methods: []string{"post"}},
+			{Domain: "example.com", PathRegex: "^/internal/", SourceCIDRs: []string{"10.0.0.0/8", "192.0.2.1"}},
+			{Domain: "example.com", PathRegex: "^/private(/.*)?$", Action: AuthActionDeny},
+		}
+	}
+	tests := []struct {
+		name     string
+		matching string
+		host     string
+		path     string
+		method   string
+		ip       string
+		expected int
+	}{
+		{
+			name:     "first match",
+			matching: AuthMatchingFirst,
+			host:     "example.com",
+			path:     "/admin",
+			method:   "GET",
+			expected: 0,
+		},
+		{
+			name:     "most specific exact path",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin",
+			method:   "GET",
+			expected: 1,
+		},
+		{
+			name:     "most specific falls back to broader rule",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin/users",
+			method:   "GET",
+			expected: 0,
+		},
+		{
+			name:     "domain regex",
+			matching: AuthMatchingMostSpecific,
+			host:     "app.example.com",
+			path:     "/admin",
+			method:   "GET",
+			expected: 2,
+		},
+		{
+			name:     "domain with port",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com:8443",
+			path:     "/admin",
+			method:   "GET",
+			expected: 1,
+		},
+		{
+			name:     "domain regex with port",
+			matching: AuthMatchingMostSpecific,
+			host:     "app.example.com:8443",
+			path:     "/",
+			method:   "GET",
+			expected: 2,
+		},
+		{
+			name:     "domain is anchored",
+			matching: AuthMatchingFirst,
+			host:     "example.com.evil.org",
+			path:     "/",
+			method:   "GET",
+			expected: -1,
+		},
+		{
+			name:     "most specific method",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin/users",
+			method:   "POST",
+			expected: 3,
+		},
+		{
+			name:     "most specific method with query",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin/users?x=1",
+			method:   "POST",
+			expected: 3,
+		},
+		{
+			name:     "most specific unknown method",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin/users",
+			method:   "",
+			expected: 0,
+		},
+		{
+			name:     "most specific method mismatch",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin/users",
+			method:   "GET",
+			expected: 0,
+		},
+		{
+			name:     "most specific source network",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/internal/status",
+			method:   "GET",
+			ip:       "10.1.2.3",
+			expected: 4,
+		},
+		{
+			name:     "most specific single source ip",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/internal/status",
+			method:   "GET",
+			ip:       "192.0.2.1",
+			expected: 4,
+		},
+		{
+			name:     "most specific other source ip",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/internal/status",
+			method:   "GET",
+			ip:       "192.0.2.2",
+			expected: 0,
+		},
+		{
+			name:     "exact path with query",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin?x=1",
+			method:   "GET",
+			expected: 1,
+		},
+		{
+			name:     "exact path with fragment",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin#x",
+			method:   "GET",
+			expected: 1,
+		},
+		{
+			name:     "exact path percent-encoded",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/%61dmin",
+			method:   "GET",
+			expected: 1,
+		},
+		{
+			name:     "exact path does not match trailing slash",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/admin/",
+			method:   "GET",
+			expected: 0,
+		},
+		{
+			name:     "path regex with query",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/private?x=1",
+			method:   "GET",
+			expected: 5,
+		},
+		{
+			name:     "path regex with trailing slash",
+			matching: AuthMatchingMostSpecific,
+			host:     "example.com",
+			path:     "/private/",
+			method:   "GET",
+			expected: 5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				rules := newRules()
+				c := mustValidateRules(t, test.matching, rules...)
+				rule, _ := c.FindRule(test.host, test.path, test.method, test.ip)
+				if test.expected < 0 {
+					if rule != nil {
+						t.Fatalf("expected no rule, got rule for '%s'", rule.DomainRegex)
+					}
+					return
+				}
+				if rule != rules[test.expected] {
+					t.Fatalf("expected rule %d, got %+v", test.expected, rule)
+				}
+			},
+		)
+	}
+}
+
+func TestInvalidAuthMatching(t *testing.T) {
+	c := authConf{{Domain: "example.com"}}
+	if err := c.validate(nil, "last"); err == nil {
+		t.Fatal("expected error for invalid auth_matching")
+	}
+}
+
+func TestAuthRuleShadows(t *testing.T) {
+	tests := []struct {
+		name     string
+		earlier  *AuthRule
+		later    *AuthRule
+		expected bool
+	}{
+		{
+			name:     "same domain without path",
+			earlier:  &AuthRule{Domain: "example.com"},
+			later:    &AuthRule{Domain: "example.com", Path: "/admin"},
+			expected: true,
+		},
+		{
+			name:     "domain regex covers exact domain",
+			earlier:  &AuthRule{DomainRegex: `^.*\.example\.com$`},
+			later:    &AuthRule{Domain: "app.example.com"},
+			expected: true,
+		},
+		{
+			name:     "other domain",
+			earlier:  &AuthRule{Domain: "example.com"},
+			later:    &AuthRule{Domain: "example.org"},
+			expected: false,
+		},
+		{
+			name:     "path regex covers exact path",
+			earlier:  &AuthRule{Domain: "example.com", PathRegex: "^/admin"},
+			later:    &AuthRule{Domain: "example.com", Path: "/admin/users"},
+			expected: true,
+		},
+		{
+			name:     "exact path does not cover path regex",
+			earlier:  &AuthRule{Domain: "example.com", Path: "/admin"},
+			later:    &AuthRule{Domain: "example.com", PathRegex: "^/admin"},
+			expected: false,
+		},
+		{
+			name:     "methods subset",
+			earlier:  &AuthRule{Domain: "example.com", Methods: []string{"GET", "POST"}},
+			later:    &AuthRule{Domain: "example.com", Methods: []string{"get"}},
+			expected: true,
+		},
+		{
+			name:     "methods not a subset",
+			earlier:  &AuthRule{Domain: "example.com", Methods: []string{"GET"}},
+			later:    &AuthRule{Domain: "example.com", Methods: []string{"GET", "POST"}},
+			expected: false,
+		},
+		{
+			name:     "methods do not cover any method",
+			earlier:  &AuthRule{Domain: "example.com", Methods: []string{"GET"}},
+			later:    &AuthRule{Domain: "example.com"},
+			expected: false,
+		},
+		{
+			name:     "same source cidrs",
+			earlier:  &AuthRule{Domain: "example.com", SourceCIDRs: []string{"10.0.0.0/8"}},
+			later:    &AuthRule{Domain: "example.com", Path: "/", SourceCIDRs: []string{"10.0.0.0/8"}},
+			expected: true,
+		},
+		{
+			name:     "source cidrs do not cover any source",
+			earlier:  &AuthRule{Domain: "example.com", SourceCIDRs: []string{"10.0.0.0/8"}},
+			later:    &AuthRule{Domain: "example.com"},
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				mustValidateRules(t, AuthMatchingFirst, test.earlier, test.later)
+				if shadows := test.earlier.shadows(test.later); shadows != test.expected {
+					t.Errorf("expected shadows to be %v, got %v", test.expected, shadows)
+				}
+			},
+		)
+	}
+}
+
+func TestAuthRuleMatchCaptures(t *testing.T) {
+	rule := &AuthRule{
+		DomainRegex: `^(?P<tenant>[a-z]+)\.example\.com$`,
+		PathRegex:   `^/api/(?P<version>v[0-9]+)/`,
+	}
+	if err := rule.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	captures, ok := rule.match("acme.example.com", "/api/v2/users", "GET", "")
+	if !ok {
+		t.Fatal("expected rule to match")
+	}
+	if expected := (Captures{"tenant": "acme", "version": "v2"}); !maps.Equal(captures, expected) {
+		t.Errorf("expected captures %v, got %v", expected, captures)
+	}
+	if _, ok = rule.match("acme.example.com", "/other", "GET", ""); ok {
+		t.Error("expected rule not to match other path")
+	}
+}
+
+func TestCapturesExpand(t *testing.T) {
+	captures := Captures{"tenant": "acme", "version": "v2"}
+	tests := []struct {
+		input    string
+		expected string
+		names    []string
+	}{
+		{
+			input:    "{tenant}-users",
+			expected: "acme-users",
+			names:    []string{"tenant"},
+		},
+		{
+			input:    "/{tenant}/{version}/{tenant}",
+			expected: "/acme/v2/acme",
+			names:    []string{"tenant", "version", "tenant"},
+		},
+		{
+			input:    "{unknown}",
+			expected: "",
+			names:    []string{"unknown"},
+		},
+		{
+			input:    "{not a placeholder} {1st}",
+			expected: "{not a placeholder} {1st}",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.input, func(t *testing.T) {
+				if expanded := captures.Expand(test.input); expanded != test.expected {
+					t.Errorf("expected '%s', got '%s'", test.expected, expanded)
+				}
+				if names := PlaceholderNames(test.input); !slices.Equal(names, test.names) {
+					t.Errorf("expected placeholders %v, got %v", test.names, names)
+				}
+			},
+		)
+	}
+}
+
+func TestApplyPolicies(t *testing.T) {
+	policies := policiesConf{
+		"staff": {
+			Require:        oidfed.SliceOrSingleValue[map[model.Claim]oidfed.SliceOrSingleValue[string]]{{"groups": {"staff"}}},
+			RequireExpr:    `claims.age > 18`,
+			ForwardHeaders: map[string]oidfed.SliceOrSingleValue[model.Claim]{"X-User": {"sub"}},
+			MaxHeaderSize:  1024,
+		},
+		"admins": {
+			Require: oidfed.SliceOrSingleValue[map[model.Claim]oidfed.SliceOrSingleValue[string]]{
+				{"groups": {"admins"}},
+				{"entitlement": {"admin"}},
+			},
+			RequireExpr:    `request.method == "GET"`,
+			ForwardHeaders: map[string]oidfed.SliceOrSingleValue[model.Claim]{"X-Email": {"email"}},
+			MaxHeaderSize:  2048,
+		},
+	}
+	t.Run(
+		"combined", func(t *testing.T) {
+			rule := &AuthRule{
+				Domain:   "example.com",
+				Policy:   "staff",
+				Policies: []string{"admins"},
+			}
+			if err := rule.applyPolicies(policies); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expectedRequire := oidfed.SliceOrSingleValue[map[model.Claim]oidfed.SliceOrSingleValue[string]]{
+				{"groups": {"staff", "admins"}},
+				{"groups": {"staff"}, "entitlement": {"admin"}},
+			}
+			if len(rule.Require) != len(expectedRequire) {
+				t.Fatalf("expected require %v, got %v", expectedRequire, rule.Require)
+			}
+			for i, option := range expectedRequire {
+				if !maps.EqualFunc(
+					option, rule.Require[i], func(a, b oidfed.SliceOrSingleValue[string]) bool {
+						return slices.Equal(a, b)
+					},
+				) {
+					t.Errorf("expected require option %v, got %v", option, rule.Require[i])
+				}
+			}
+			if expected := `(claims.age > 18) && (request.method == "GET")`; rule.RequireExpr != expected {
+				t.Errorf("expected require_expr '%s', got '%s'", expected, rule.RequireExpr)
+			}
+			if len(rule.ForwardHeaders) != 2 {
+				t.Errorf("expected forward headers of both policies, got %v", rule.ForwardHeaders)
+			}
+			if rule.MaxHeaderSize != 2048 {
+				t.Errorf("expected later policy to take precedence, got max_header_size %d", rule.MaxHeaderSize)
+			}
+			// the policies must not be modified by combining them
+			if len(policies["staff"].Require[0]["groups"]) != 1 {
+				t.Errorf("policy was modified: %v", policies["staff"].Require)
+			}
+		},
+	)
+	t.Run(
+		"rule overrides policy", func(t *testing.T) {
+			rule := &AuthRule{
+				Domain:        "example.com",
+				Policy:        "staff",
+				RequireExpr:   `claims.sub == "user"`,
+				MaxHeaderSize: 512,
+			}
+			if err := rule.applyPolicies(policies); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rule.RequireExpr != `claims.sub == "user"` {
+				t.Errorf("expected rule require_expr, got '%s'", rule.RequireExpr)
+			}
+			if rule.MaxHeaderSize != 512 {
+				t.Errorf("expected rule max_header_size, got %d", rule.MaxHeaderSize)
+			}
+			if len(rule.Require) != 1 {
+				t.Errorf("expected policy require, got %v", rule.Require)
+			}
+		},
+	)
+	t.Run(
+		"unknown policy", func(t *testing.T) {
+			rule := &AuthRule{
+				Domain: "example.com",
+				Policy: "unknown",
+			}
+			err := rule.applyPolicies(policies)
+			if err == nil || !strings.Contains(err.Error(), "unknown policy 'unknown'") {
+				t.Fatalf("expected unknown policy error, got %v", err)
+			}
+		},
+	)
+}
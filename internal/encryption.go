@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/offa/internal/config"
+)
+
+const SessionEncryptionKeyName = "session.enc.key"
+const CookieSigningKeyName = "cookie.sign.key"
+
+const symmetricKeyLen = 32
+
+func mustLoadSymmetricKey(name string) []byte {
+	data, err := os.ReadFile(path.Join(config.Get().Federation.KeyStorage, name))
+	if err != nil {
+		key := make([]byte, symmetricKeyLen)
+		if _, err = rand.Read(key); err != nil {
+			log.Fatal(err)
+		}
+		if err = os.WriteFile(path.Join(config.Get().Federation.KeyStorage, name), key, 0600); err != nil {
+			log.Fatal(err)
+		}
+		return key
+	}
+	if len(data) != symmetricKeyLen {
+		log.Fatalf("invalid key length for '%s'", name)
+	}
+	return data
+}
+
+var encryptionAEAD cipher.AEAD
+
+// InitEncryptionKey loads (or generates) the symmetric key with the passed
+// name that is used by Encrypt and Decrypt
+func InitEncryptionKey(name string) {
+	block, err := aes.NewCipher(mustLoadSymmetricKey(name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	encryptionAEAD, err = cipher.NewGCM(block)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+var signingKey []byte
+
+// InitSigningKey loads (or generates) the symmetric key with the passed name
+// that is used by Sign and VerifySigned
+func InitSigningKey(name string) {
+	signingKey = mustLoadSymmetricKey(name)
+}
+
+func hmacSignature(value string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the passed value with an appended HMAC-SHA256 signature
+func Sign(value string) string {
+	return value + "." + hmacSignature(value)
+}
+
+// VerifySigned verifies a value created by Sign and returns the original
+// value
+func VerifySigned(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value, signature := signed[:i], signed[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(hmacSignature(value))) {
+		return "", false
+	}
+	return value, true
+}
+
+// Encrypt encrypts the passed plaintext with AES-GCM and returns the base64
+// encoded nonce and ciphertext
+func Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, encryptionAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.WithStack(err)
+	}
+	ciphertext := encryptionAEAD.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt decrypts a ciphertext created by Encrypt
+func Decrypt(ciphertext string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	nonceSize := encryptionAEAD.NonceSize()
+	if len(data) < nonceSize {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := encryptionAEAD.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,107 @@
+package expr
+
+import (
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+// costLimit limits the evaluation cost of a single expression, so that
+// expressions cannot block the forward auth endpoint
+const costLimit = 100000
+
+// Request holds the attributes of the request that are available in
+// expressions
+type Request struct {
+	Host     string
+	Path     string
+	Method   string
+	ClientIP string
+	Captures map[string]string
+}
+
+func (r Request) toMap() map[string]string {
+	return map[string]string{
+		"host":   r.Host,
+		"path":   r.Path,
+		"method": r.Method,
+		"ip":     r.ClientIP,
+	}
+}
+
+// Program is a compiled expression
+type Program struct {
+	expression string
+	program    cel.Program
+}
+
+var env *cel.Env
+
+func init() {
+	var err error
+	env, err = cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("captures", cel.MapType(cel.StringType, cel.StringType)),
+		cel.CrossTypeNumericComparisons(true),
+		ext.Strings(),
+		ext.Sets(),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Compile compiles an expression. The expression must evaluate to a
+// boolean.
+func Compile(expression string) (*Program, error) {
+	ast, iss := env.Compile(expression)
+	if iss.Err() != nil {
+		return nil, errors.WithStack(iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, errors.Errorf("expression must evaluate to bool, but evaluates to %s", ast.OutputType())
+	}
+	prg, err := env.Program(ast, cel.CostLimit(costLimit))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Program{
+		expression: expression,
+		program:    prg,
+	}, nil
+}
+
+// String returns the source of the expression
+func (p *Program) String() string {
+	return p.expression
+}
+
+// Evaluate evaluates the expression for the passed claims and request
+func (p *Program) Evaluate(claims model.UserClaims, req Request) (bool, error) {
+	cls := make(map[string]any, len(claims))
+	for k, v := range claims {
+		cls[string(k)] = v
+	}
+	captures := req.Captures
+	if captures == nil {
+		captures = map[string]string{}
+	}
+	out, _, err := p.program.Eval(
+		map[string]any{
+			"claims":   cls,
+			"request":  req.toMap(),
+			"captures": captures,
+		},
+	)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, errors.Errorf("expression did not evaluate to bool, but to %T", out.Value())
+	}
+	return b, nil
+}
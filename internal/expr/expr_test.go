@@ -0,0 +1,101 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func TestEvaluate(t *testing.T) {
+	claims := model.UserClaims{
+		"sub":    "user",
+		"groups": []any{"staff", "admins"},
+		"age":    42,
+	}
+	req := Request{
+		Host:     "tenant.example.com",
+		Path:     "/api",
+		Method:   "GET",
+		ClientIP: "192.0.2.1",
+		Captures: map[string]string{"tenant": "tenant"},
+	}
+	tests := []struct {
+		name       string
+		expression string
+		expected   bool
+		wantErr    bool
+		errContent string
+	}{
+		{
+			name:       "claim",
+			expression: `claims.sub == "user"`,
+			expected:   true,
+		},
+		{
+			name:       "list membership",
+			expression: `"admins" in claims.groups`,
+			expected:   true,
+		},
+		{
+			name:       "numeric comparison",
+			expression: `claims.age > 40.5`,
+			expected:   true,
+		},
+		{
+			name:       "request",
+			expression: `request.method == "POST"`,
+			expected:   false,
+		},
+		{
+			name:       "captures",
+			expression: `request.host.startsWith(captures.tenant + ".")`,
+			expected:   true,
+		},
+		{
+			name:       "missing claim",
+			expression: `claims.email == "user@example.com"`,
+			wantErr:    true,
+		},
+		{
+			name:       "cost limit exceeded",
+			expression: `[1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(a, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(b, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(c, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(d, [1, 2, 3, 4, 5, 6, 7, 8, 9, 10].all(e, a + b + c + d + e > 0)))))`,
+			wantErr:    true,
+			errContent: "cost limit exceeded",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				prg, err := Compile(test.expression)
+				if err != nil {
+					t.Fatalf("unexpected compile error: %v", err)
+				}
+				result, err := prg.Evaluate(claims, req)
+				if test.wantErr {
+					if err == nil {
+						t.Fatalf("expected error, got %v", result)
+					}
+					if !strings.Contains(err.Error(), test.errContent) {
+						t.Errorf("expected error containing %q, got %v", test.errContent, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if result != test.expected {
+					t.Errorf("expected %v, got %v", test.expected, result)
+				}
+			},
+		)
+	}
+}
+
+func TestCompileRejectsNonBool(t *testing.T) {
+	for _, expression := range []string{`"string"`, `1 + 2`, `claims.sub ==`} {
+		if _, err := Compile(expression); err == nil {
+			t.Errorf("expected error for expression %q", expression)
+		}
+	}
+}
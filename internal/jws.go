@@ -12,6 +12,8 @@ import (
 	"path"
 
 	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/pkg/errors"
 
 	"github.com/go-oidfed/lib/jwks"
 
@@ -20,6 +22,7 @@ import (
 
 const FedSigningKeyName = "fed.signing.key"
 const OIDCSigningKeyName = "oidc.signing.key"
+const AssertionSigningKeyName = "assertion.signing.key"
 
 func mustNewKey() *ecdsa.PrivateKey {
 	sk, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
@@ -69,6 +72,24 @@ func GetJWKS(name string) *jwks.JWKS {
 	return &set
 }
 
+// SignJWT signs the passed payload as jwt with the key with the passed name;
+// the key id is included in the header
+func SignJWT(name string, payload []byte) ([]byte, error) {
+	headers := jws.NewHeaders()
+	if err := headers.Set(jws.TypeKey, "JWT"); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if key, ok := GetJWKS(name).Key(0); ok {
+		if kid, ok := key.KeyID(); ok {
+			if err := headers.Set(jws.KeyIDKey, kid); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+	signed, err := jws.Sign(payload, jws.WithKey(jwa.ES512(), GetKey(name), jws.WithProtectedHeaders(headers)))
+	return signed, errors.WithStack(err)
+}
+
 func exportECPrivateKeyAsPem(privkey *ecdsa.PrivateKey) []byte {
 	privkeyBytes, _ := x509.MarshalECPrivateKey(privkey)
 	privkeyPem := pem.EncodeToMemory(
@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+)
+
+// Session holds the data that is stored for a user session
+type Session struct {
+	Claims                UserClaims
+	IDToken               string
+	EncryptedRefreshToken string
+	LastValidated         time.Time
+	ExpiresAt             time.Time
+	// LoginTime is the time of the login that created the session; it is
+	// not changed by revalidations or extensions
+	LoginTime time.Time
+}
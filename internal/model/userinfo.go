@@ -1,7 +1,11 @@
 package model
 
 import (
+	"encoding/json"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Claim string
@@ -9,13 +13,21 @@ type Claim string
 // UserClaims holds claims about a user
 type UserClaims map[Claim]any
 
+// GetForHeader returns the value of a claim in the format used for http
+// headers
 func (claims UserClaims) GetForHeader(claim Claim) (string, bool) {
 	return claims.getAsString(claim, ",")
 }
+
+// GetForMemCache returns the value of a claim in the format used for
+// memcached
 func (claims UserClaims) GetForMemCache(claim Claim) (string, bool) {
 	return claims.getAsString(claim, ":")
 }
 
+// getAsString returns the value of a claim as a single string. Scalar values
+// are formatted, arrays are joined with the sliceSeparator, and objects are
+// json encoded.
 func (claims UserClaims) getAsString(claim Claim, sliceSeparator string) (string, bool) {
 	v, ok := claims.GetString(claim)
 	if ok {
@@ -25,23 +37,233 @@ func (claims UserClaims) getAsString(claim Claim, sliceSeparator string) (string
 	if ok {
 		return strings.Join(vs, sliceSeparator), true
 	}
-	return "", false
+	value, ok := claims.Get(claim)
+	if !ok || value == nil {
+		return "", false
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Get returns the raw value of a claim. The claim can either be a claim
+// name, a dotted path into nested claims (e.g. 'address.country'), or a json
+// pointer (e.g. '/address/country').
+// A claim name that exists as is, takes precedence over a dotted path.
+func (claims UserClaims) Get(claim Claim) (any, bool) {
+	if v, ok := claims[claim]; ok {
+		return v, true
+	}
+	c := string(claim)
+	var path []string
+	switch {
+	case strings.HasPrefix(c, "/"):
+		for _, p := range strings.Split(c[1:], "/") {
+			path = append(path, strings.ReplaceAll(strings.ReplaceAll(p, "~1", "/"), "~0", "~"))
+		}
+	case strings.Contains(c, "."):
+		path = strings.Split(c, ".")
+	default:
+		return nil, false
+	}
+	var current any = map[Claim]any(claims)
+	for _, p := range path {
+		var ok bool
+		current, ok = getChild(current, p)
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// getChild returns the child of an object or array value
+func getChild(value any, key string) (any, bool) {
+	switch v := value.(type) {
+	case map[Claim]any:
+		child, ok := v[Claim(key)]
+		return child, ok
+	case map[string]any:
+		child, ok := v[key]
+		return child, ok
+	case map[any]any:
+		child, ok := v[key]
+		return child, ok
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || i >= rv.Len() {
+		return nil, false
+	}
+	return rv.Index(i).Interface(), true
 }
 
+// GetString returns the value of a claim as string if it is a scalar value,
+// i.e. a string, a number, or a boolean
 func (claims UserClaims) GetString(claim Claim) (string, bool) {
-	v, ok := claims[claim]
+	v, ok := claims.Get(claim)
 	if !ok {
 		return "", false
 	}
-	s, ok := v.(string)
-	return s, ok
+	return FormatScalar(v)
 }
 
+// GetStringSlice returns the value of a claim as a slice of strings if it is
+// an array. Scalar array elements are formatted, other elements are json
+// encoded.
 func (claims UserClaims) GetStringSlice(claim Claim) ([]string, bool) {
-	v, ok := claims[claim]
+	v, ok := claims.Get(claim)
+	if !ok {
+		return nil, false
+	}
+	return FormatSlice(v)
+}
+
+// FormatSlice returns the passed value as a slice of strings if it is an
+// array. Scalar array elements are formatted, other elements are json
+// encoded.
+func FormatSlice(v any) ([]string, bool) {
+	if s, ok := v.([]string); ok {
+		return s, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	values := make([]string, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		e := rv.Index(i).Interface()
+		if s, ok := FormatScalar(e); ok {
+			values = append(values, s)
+			continue
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, string(data))
+	}
+	return values, true
+}
+
+// GetNumber returns the value of a claim as float64 if it is a number
+func (claims UserClaims) GetNumber(claim Claim) (float64, bool) {
+	v, ok := claims.Get(claim)
+	if !ok {
+		return 0, false
+	}
+	return toFloat(v)
+}
+
+// GetBool returns the value of a claim if it is a boolean
+func (claims UserClaims) GetBool(claim Claim) (bool, bool) {
+	v, ok := claims.Get(claim)
 	if !ok {
+		return false, false
+	}
+	b, ok := v.(bool)
+	return b, ok
+}
+
+// GetObject returns the value of a claim if it is an object
+func (claims UserClaims) GetObject(claim Claim) (map[string]any, bool) {
+	v, ok := claims.Get(claim)
+	if !ok {
+		return nil, false
+	}
+	switch o := v.(type) {
+	case map[string]any:
+		return o, true
+	case map[Claim]any:
+		m := make(map[string]any, len(o))
+		for k, e := range o {
+			m[string(k)] = e
+		}
+		return m, true
+	case map[any]any:
+		m := make(map[string]any, len(o))
+		for k, e := range o {
+			if ks, ok := k.(string); ok {
+				m[ks] = e
+			}
+		}
+		return m, true
+	default:
 		return nil, false
 	}
-	s, ok := v.([]string)
-	return s, ok
+}
+
+// FormatScalar returns the passed value as string if it is a scalar value,
+// i.e. a string, a number, or a boolean
+func FormatScalar(v any) (string, bool) {
+	switch s := v.(type) {
+	case string:
+		return s, true
+	case bool:
+		return strconv.FormatBool(s), true
+	case json.Number:
+		return s.String(), true
+	}
+	if f, ok := toFloat(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	default:
+		return 0, false
+	}
+}
+
+// Merge merges the passed claims into these claims. If overwrite is true,
+// claims that are set in both are overwritten with the value from other,
+// otherwise the existing value is kept.
+func (claims UserClaims) Merge(other UserClaims, overwrite bool) {
+	for k, v := range other {
+		if _, set := claims[k]; set && !overwrite {
+			continue
+		}
+		claims[k] = v
+	}
+}
+
+// GetAudience returns the values of the aud claim; aud can either be a
+// single string or an array of strings
+func (claims UserClaims) GetAudience() []string {
+	if aud, ok := claims.GetString("aud"); ok {
+		return []string{aud}
+	}
+	aud, _ := claims.GetStringSlice("aud")
+	return aud
+}
+
+// GetTime returns the value of a numeric date claim (e.g. exp or iat) as
+// time.Time
+func (claims UserClaims) GetTime(claim Claim) (time.Time, bool) {
+	sec, ok := claims.GetNumber(claim)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(sec*float64(time.Second))), true
 }
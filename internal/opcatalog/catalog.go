@@ -0,0 +1,311 @@
+package opcatalog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// OP is an OpenID Provider that is offered on the login page
+type OP struct {
+	EntityID         string `json:"entity_id"`
+	DisplayName      string `json:"display_name"`
+	KeyWords         string `json:"keywords,omitempty"`
+	LogoURI          string `json:"logo_uri,omitempty"`
+	InformationURI   string `json:"information_uri,omitempty"`
+	OrganizationName string `json:"organization_name,omitempty"`
+	// DisplayNames holds language specific display names by language tag
+	DisplayNames map[string]string `json:"display_names,omitempty"`
+	// TrustChains holds the valid trust chains of the OP at collection time
+	TrustChains []TrustChain `json:"trust_chains,omitempty"`
+}
+
+// TrustChain holds the information from a trust chain of an OP that is
+// needed to check whether the OP is accepted by an auth rule
+type TrustChain struct {
+	// Entities holds the entity ids of the superiors in the chain, i.e. the
+	// intermediates and the trust anchor
+	Entities []string `json:"entities"`
+	// TrustMarks holds the types of the OP's trust marks that are valid
+	// within the chain
+	TrustMarks []string `json:"trust_marks,omitempty"`
+}
+
+// CollectFunc collects the OPs below a trust anchor. It returns an error if
+// the collection failed, in which case the last good OPs of the trust anchor
+// are kept.
+type CollectFunc func(trustAnchor string) ([]OP, error)
+
+// TrustAnchorStatus reports the result of the last collection run for a
+// trust anchor
+type TrustAnchorStatus struct {
+	TrustAnchor string    `json:"trust_anchor"`
+	LastRun     time.Time `json:"last_run,omitzero"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	Duration    float64   `json:"duration_seconds"`
+	OPs         int       `json:"ops"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Snapshot is an immutable state of a Catalog
+type Snapshot struct {
+	OPs          []OP                `json:"-"`
+	TrustAnchors []TrustAnchorStatus `json:"trust_anchors"`
+	UpdatedAt    time.Time           `json:"updated_at,omitzero"`
+	byTA         map[string][]OP
+}
+
+// persistedCatalog is the format in which a Snapshot is persisted
+type persistedCatalog struct {
+	UpdatedAt    time.Time                 `json:"updated_at"`
+	TrustAnchors []persistedTrustAnchorOPs `json:"trust_anchors"`
+}
+
+type persistedTrustAnchorOPs struct {
+	Status TrustAnchorStatus `json:"status"`
+	OPs    []OP              `json:"ops"`
+}
+
+// Catalog holds the OPs collected from the trust anchors. Readers always
+// get a consistent Snapshot, since a new Snapshot is swapped in atomically
+// after a collection run.
+type Catalog struct {
+	collect      CollectFunc
+	trustAnchors []string
+	file         string
+	current      atomic.Pointer[Snapshot]
+	refreshing   atomic.Bool
+	refreshMu    sync.Mutex
+}
+
+// New creates a new Catalog for the passed trust anchors. If a file is
+// passed, the last good catalog is persisted to it and loaded from it on
+// startup, so that OPs are available before the first collection run
+// finished.
+func New(collect CollectFunc, trustAnchors []string, file string) *Catalog {
+	c := &Catalog{
+		collect:      collect,
+		trustAnchors: trustAnchors,
+		file:         file,
+	}
+	s, err := c.load()
+	if err != nil {
+		log.WithError(err).Warn("Could not load persisted op catalog")
+	}
+	if s == nil {
+		s = c.newSnapshot(nil, nil)
+	}
+	c.current.Store(s)
+	return c
+}
+
+// Snapshot returns the current Snapshot of the Catalog
+func (c *Catalog) Snapshot() *Snapshot {
+	return c.current.Load()
+}
+
+// OPs returns the OPs of the current Snapshot
+func (c *Catalog) OPs() []OP {
+	return c.Snapshot().OPs
+}
+
+// Refreshing checks if a collection run is in progress
+func (c *Catalog) Refreshing() bool {
+	return c.refreshing.Load()
+}
+
+// Refresh collects the OPs from all trust anchors and swaps in the new
+// Snapshot. Concurrent calls are serialized.
+func (c *Catalog) Refresh() *Snapshot {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	return c.refresh()
+}
+
+// RefreshAsync starts a collection run in the background. It returns false
+// if a collection run is already in progress.
+func (c *Catalog) RefreshAsync() bool {
+	if !c.refreshMu.TryLock() {
+		return false
+	}
+	go func() {
+		defer c.refreshMu.Unlock()
+		c.refresh()
+	}()
+	return true
+}
+
+// refresh does a collection run; the caller must hold the refreshMu
+func (c *Catalog) refresh() *Snapshot {
+	c.refreshing.Store(true)
+	defer c.refreshing.Store(false)
+
+	previous := c.Snapshot()
+	statuses := make([]TrustAnchorStatus, len(c.trustAnchors))
+	byTA := make(map[string][]OP, len(c.trustAnchors))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, ta := range c.trustAnchors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status := previous.status(ta)
+			status.LastRun = time.Now()
+			ops, err := c.collect(ta)
+			status.Duration = time.Since(status.LastRun).Seconds()
+			if err != nil {
+				log.WithError(err).WithField("trust_anchor", ta).Error("OP collection failed")
+				status.Error = err.Error()
+				ops = previous.byTA[ta]
+			} else {
+				status.Error = ""
+				status.LastSuccess = status.LastRun
+			}
+			status.OPs = len(ops)
+			statuses[i] = status
+			mu.Lock()
+			byTA[ta] = ops
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	s := c.newSnapshot(byTA, statuses)
+	s.UpdatedAt = time.Now()
+	c.current.Store(s)
+	if err := c.persist(s); err != nil {
+		log.WithError(err).Error("Could not persist op catalog")
+	}
+	return s
+}
+
+// Schedule refreshes the Catalog now and then in the passed interval; if the
+// interval is not positive, the Catalog is only refreshed once
+func (c *Catalog) Schedule(interval time.Duration) {
+	go func() {
+		c.Refresh()
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			c.Refresh()
+		}
+	}()
+}
+
+// newSnapshot creates a Snapshot from the OPs per trust anchor. OPs that are
+// collected from multiple trust anchors are only contained once.
+func (c *Catalog) newSnapshot(byTA map[string][]OP, statuses []TrustAnchorStatus) *Snapshot {
+	if statuses == nil {
+		statuses = make([]TrustAnchorStatus, len(c.trustAnchors))
+		for i, ta := range c.trustAnchors {
+			statuses[i] = TrustAnchorStatus{TrustAnchor: ta}
+		}
+	}
+	s := &Snapshot{
+		TrustAnchors: statuses,
+		byTA:         byTA,
+	}
+	seen := make(map[string]bool)
+	for _, ta := range c.trustAnchors {
+		for _, op := range byTA[ta] {
+			if !seen[op.EntityID] {
+				seen[op.EntityID] = true
+				s.OPs = append(s.OPs, op)
+			}
+		}
+	}
+	slices.SortFunc(
+		s.OPs, func(a, b OP) int {
+			return strings.Compare(strings.ToLower(a.DisplayName), strings.ToLower(b.DisplayName))
+		},
+	)
+	return s
+}
+
+// status returns the TrustAnchorStatus of the passed trust anchor
+func (s *Snapshot) status(trustAnchor string) TrustAnchorStatus {
+	for _, status := range s.TrustAnchors {
+		if status.TrustAnchor == trustAnchor {
+			return status
+		}
+	}
+	return TrustAnchorStatus{TrustAnchor: trustAnchor}
+}
+
+// persist writes the Snapshot to the Catalog's file; the file is replaced
+// atomically, so that a crash cannot leave a partially written catalog
+func (c *Catalog) persist(s *Snapshot) error {
+	if c.file == "" {
+		return nil
+	}
+	p := persistedCatalog{UpdatedAt: s.UpdatedAt}
+	for _, status := range s.TrustAnchors {
+		p.TrustAnchors = append(
+			p.TrustAnchors, persistedTrustAnchorOPs{
+				Status: status,
+				OPs:    s.byTA[status.TrustAnchor],
+			},
+		)
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.WithStack(err)
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp.Name(), c.file))
+}
+
+// load loads a persisted Snapshot; the OPs of trust anchors that are no
+// longer configured are ignored
+func (c *Catalog) load() (*Snapshot, error) {
+	if c.file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	var p persistedCatalog
+	if err = json.Unmarshal(data, &p); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	byTA := make(map[string][]OP, len(p.TrustAnchors))
+	statuses := make([]TrustAnchorStatus, len(c.trustAnchors))
+	for i, ta := range c.trustAnchors {
+		statuses[i] = TrustAnchorStatus{TrustAnchor: ta}
+		for _, e := range p.TrustAnchors {
+			if e.Status.TrustAnchor == ta {
+				statuses[i] = e.Status
+				byTA[ta] = e.OPs
+			}
+		}
+	}
+	s := c.newSnapshot(byTA, statuses)
+	s.UpdatedAt = p.UpdatedAt
+	log.WithField("ops", len(s.OPs)).Info("Loaded persisted op catalog")
+	return s, nil
+}
@@ -0,0 +1,122 @@
+package opcatalog
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// fakeCollector returns the configured OPs or error per trust anchor
+type fakeCollector struct {
+	ops  map[string][]OP
+	errs map[string]error
+}
+
+func (f *fakeCollector) collect(trustAnchor string) ([]OP, error) {
+	if err := f.errs[trustAnchor]; err != nil {
+		return nil, err
+	}
+	return f.ops[trustAnchor], nil
+}
+
+func entityIDs(ops []OP) (ids []string) {
+	for _, op := range ops {
+		ids = append(ids, op.EntityID)
+	}
+	return
+}
+
+func TestCatalogRefresh(t *testing.T) {
+	const (
+		ta1 = "https://ta1.example.org"
+		ta2 = "https://ta2.example.org"
+	)
+	collector := &fakeCollector{
+		ops: map[string][]OP{
+			ta1: {
+				{EntityID: "https://b.example.org", DisplayName: "B"},
+				{EntityID: "https://a.example.org", DisplayName: "a"},
+			},
+			ta2: {
+				{EntityID: "https://a.example.org", DisplayName: "a"},
+				{EntityID: "https://c.example.org", DisplayName: "C"},
+			},
+		},
+	}
+	c := New(collector.collect, []string{ta1, ta2}, "")
+	s := c.Refresh()
+	if ids := entityIDs(s.OPs); !slices.Equal(
+		ids, []string{"https://a.example.org", "https://b.example.org", "https://c.example.org"},
+	) {
+		t.Fatalf("unexpected ops after refresh: %v", ids)
+	}
+
+	// A failing trust anchor keeps its last good OPs
+	collector.errs = map[string]error{ta2: errors.New("unreachable")}
+	collector.ops[ta1] = nil
+	s = c.Refresh()
+	if ids := entityIDs(s.OPs); !slices.Equal(ids, []string{"https://a.example.org", "https://c.example.org"}) {
+		t.Fatalf("unexpected ops after failed refresh: %v", ids)
+	}
+	for _, status := range s.TrustAnchors {
+		switch status.TrustAnchor {
+		case ta1:
+			if status.Error != "" || status.OPs != 0 || status.LastSuccess.IsZero() {
+				t.Errorf("expected successful empty collection for %s, got %+v", ta1, status)
+			}
+		case ta2:
+			if status.Error != "unreachable" || status.OPs != 2 {
+				t.Errorf("expected failed collection with previous ops for %s, got %+v", ta2, status)
+			}
+		}
+	}
+}
+
+func TestCatalogPersistence(t *testing.T) {
+	const (
+		ta1 = "https://ta1.example.org"
+		ta2 = "https://ta2.example.org"
+	)
+	file := filepath.Join(t.TempDir(), "op_catalog.json")
+	collector := &fakeCollector{
+		ops: map[string][]OP{
+			ta1: {
+				{
+					EntityID:     "https://a.example.org",
+					DisplayName:  "A",
+					DisplayNames: map[string]string{"de": "A (de)"},
+					TrustChains: []TrustChain{
+						{
+							Entities:   []string{ta1},
+							TrustMarks: []string{"https://refeds.org/sirtfi"},
+						},
+					},
+				},
+			},
+			ta2: {{EntityID: "https://b.example.org", DisplayName: "B"}},
+		},
+	}
+	c := New(collector.collect, []string{ta1, ta2}, file)
+	c.Refresh()
+
+	failing := &fakeCollector{errs: map[string]error{ta1: errors.New("down")}}
+	loaded := New(failing.collect, []string{ta1}, file)
+	ops := loaded.OPs()
+	if ids := entityIDs(ops); !slices.Equal(ids, []string{"https://a.example.org"}) {
+		t.Fatalf("expected only ops of configured trust anchors to be loaded, got %v", ids)
+	}
+	if ops[0].DisplayNames["de"] != "A (de)" || len(ops[0].TrustChains) != 1 {
+		t.Errorf("op not loaded completely: %+v", ops[0])
+	}
+	if s := loaded.Refresh(); len(s.OPs) != 1 || s.TrustAnchors[0].Error != "down" {
+		t.Errorf("expected persisted ops to be kept on failure, got %+v", s)
+	}
+}
+
+func TestNewWithoutFile(t *testing.T) {
+	c := New((&fakeCollector{}).collect, []string{"https://ta.example.org"}, "")
+	if len(c.OPs()) != 0 || len(c.Snapshot().TrustAnchors) != 1 {
+		t.Errorf("unexpected initial snapshot: %+v", c.Snapshot())
+	}
+}
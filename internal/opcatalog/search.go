@@ -0,0 +1,144 @@
+package opcatalog
+
+import (
+	"cmp"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/lithammer/fuzzysearch/fuzzy"
+)
+
+// LocalizedDisplayName returns the display name of the OP for the passed
+// language tag; if there is none for the language or its base language,
+// the default display name is returned
+func (op OP) LocalizedDisplayName(lang string) string {
+	if lang == "" || len(op.DisplayNames) == 0 {
+		return op.DisplayName
+	}
+	lang = strings.ToLower(lang)
+	for tag, name := range op.DisplayNames {
+		if strings.ToLower(tag) == lang {
+			return name
+		}
+	}
+	if base, _, found := strings.Cut(lang, "-"); found {
+		return op.LocalizedDisplayName(base)
+	}
+	return op.DisplayName
+}
+
+// Domain returns the host of the OP's entity id
+func (op OP) Domain() string {
+	u, err := url.Parse(op.EntityID)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// noMatch is the score of an OP that does not match a query
+const noMatch = -1
+
+// score returns how well the OP matches the query; lower is better. A
+// case-insensitive substring match of any field ranks before fuzzy matches,
+// and a match at the start of a field before other substring matches.
+func (op OP) score(query, lang string) int {
+	best := noMatch
+	for _, field := range []string{
+		op.LocalizedDisplayName(lang), op.DisplayName, op.OrganizationName, op.Domain(), op.KeyWords,
+	} {
+		if field == "" {
+			continue
+		}
+		var s int
+		lower := strings.ToLower(field)
+		switch i := strings.Index(lower, query); {
+		case i == 0:
+			s = 0
+		case i > 0:
+			s = 1
+		default:
+			d := fuzzy.RankMatchNormalizedFold(query, field)
+			if d < 0 {
+				continue
+			}
+			s = 2 + d
+		}
+		if best == noMatch || s < best {
+			best = s
+		}
+	}
+	return best
+}
+
+// SearchRequest holds the parameters of a Search
+type SearchRequest struct {
+	// Query is matched against the display names, organization name,
+	// domain, and keywords of the OPs; if empty all OPs are returned
+	Query string
+	// Lang is the preferred language for display names
+	Lang string
+	// LastOP is the entity id of the OP the user last logged in with; it
+	// ranks first among equally good matches
+	LastOP string
+	Offset int
+	Limit  int
+}
+
+// Search searches the passed OPs and returns the requested page of the
+// results as well as the total number of results. OPs are ranked by how
+// well they match the query; among equally good matches the user's last OP
+// comes first, the others are sorted by name.
+func Search(ops []OP, req SearchRequest) ([]OP, int) {
+	type result struct {
+		op    OP
+		score int
+		last  bool
+	}
+	query := strings.ToLower(strings.TrimSpace(req.Query))
+	var results []result
+	for _, op := range ops {
+		score := 0
+		if query != "" {
+			if score = op.score(query, req.Lang); score == noMatch {
+				continue
+			}
+		}
+		results = append(
+			results, result{
+				op:    op,
+				score: score,
+				last:  req.LastOP != "" && op.EntityID == req.LastOP,
+			},
+		)
+	}
+	slices.SortStableFunc(
+		results, func(a, b result) int {
+			if a.score == b.score && a.last != b.last {
+				if a.last {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Or(
+				cmp.Compare(a.score, b.score),
+				strings.Compare(
+					strings.ToLower(a.op.LocalizedDisplayName(req.Lang)),
+					strings.ToLower(b.op.LocalizedDisplayName(req.Lang)),
+				),
+			)
+		},
+	)
+	total := len(results)
+	start := min(max(req.Offset, 0), total)
+	end := total
+	if req.Limit > 0 {
+		end = min(start+req.Limit, total)
+	}
+	page := make([]OP, 0, end-start)
+	for _, r := range results[start:end] {
+		page = append(page, r.op)
+	}
+	return page, total
+}
@@ -0,0 +1,147 @@
+package opcatalog
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	ops := []OP{
+		{
+			EntityID:    "https://login.uni-a.example.org",
+			DisplayName: "University A",
+			DisplayNames: map[string]string{
+				"de": "Universität A",
+			},
+		},
+		{
+			EntityID:         "https://op.uni-b.example.org",
+			DisplayName:      "University B",
+			OrganizationName: "B Research Org",
+		},
+		{
+			EntityID:    "https://idp.example.com",
+			DisplayName: "Example IdP",
+			KeyWords:    "research university",
+		},
+		{
+			EntityID:    "https://social.example.net",
+			DisplayName: "Social Login",
+		},
+	}
+	tests := []struct {
+		name     string
+		req      SearchRequest
+		expected []string
+		total    int
+	}{
+		{
+			name: "all sorted by name",
+			req:  SearchRequest{},
+			expected: []string{
+				"https://idp.example.com", "https://social.example.net", "https://login.uni-a.example.org",
+				"https://op.uni-b.example.org",
+			},
+			total: 4,
+		},
+		{
+			name: "last op first without query",
+			req:  SearchRequest{LastOP: "https://op.uni-b.example.org"},
+			expected: []string{
+				"https://op.uni-b.example.org", "https://idp.example.com", "https://social.example.net",
+				"https://login.uni-a.example.org",
+			},
+			total: 4,
+		},
+		{
+			name: "prefix before substring",
+			req:  SearchRequest{Query: "univ"},
+			expected: []string{
+				"https://login.uni-a.example.org", "https://op.uni-b.example.org", "https://idp.example.com",
+			},
+			total: 3,
+		},
+		{
+			name: "last op only breaks ties",
+			req: SearchRequest{
+				Query:  "univ",
+				LastOP: "https://idp.example.com",
+			},
+			expected: []string{
+				"https://login.uni-a.example.org", "https://op.uni-b.example.org", "https://idp.example.com",
+			},
+			total: 3,
+		},
+		{
+			name: "last op first within tier",
+			req: SearchRequest{
+				Query:  "univ",
+				LastOP: "https://op.uni-b.example.org",
+			},
+			expected: []string{
+				"https://op.uni-b.example.org", "https://login.uni-a.example.org", "https://idp.example.com",
+			},
+			total: 3,
+		},
+		{
+			name:     "organization name",
+			req:      SearchRequest{Query: "b research"},
+			expected: []string{"https://op.uni-b.example.org"},
+			total:    1,
+		},
+		{
+			name:     "domain",
+			req:      SearchRequest{Query: "social.example"},
+			expected: []string{"https://social.example.net"},
+			total:    1,
+		},
+		{
+			name:     "fuzzy",
+			req:      SearchRequest{Query: "scl lgn"},
+			expected: []string{"https://social.example.net"},
+			total:    1,
+		},
+		{
+			name:     "localized",
+			req:      SearchRequest{Query: "universität", Lang: "de-DE"},
+			expected: []string{"https://login.uni-a.example.org"},
+			total:    1,
+		},
+		{
+			name: "page",
+			req: SearchRequest{
+				Offset: 1,
+				Limit:  2,
+			},
+			expected: []string{"https://social.example.net", "https://login.uni-a.example.org"},
+			total:    4,
+		},
+		{
+			name:  "offset out of range",
+			req:   SearchRequest{Offset: 10},
+			total: 4,
+		},
+		{
+			name:  "no match",
+			req:   SearchRequest{Query: "zzz"},
+			total: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				results, total := Search(ops, test.req)
+				var ids []string
+				for _, op := range results {
+					ids = append(ids, op.EntityID)
+				}
+				if !slices.Equal(ids, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, ids)
+				}
+				if total != test.total {
+					t.Errorf("expected total %d, got %d", test.total, total)
+				}
+			},
+		)
+	}
+}
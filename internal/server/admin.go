@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/opcatalog"
+)
+
+// addAdminHandlers adds the admin endpoints; they are only available if an
+// admin token is configured
+func addAdminHandlers(s fiber.Router) {
+	if config.Get().Server.AdminToken == "" {
+		return
+	}
+	admin := s.Group(config.Get().Server.Paths.Admin, requireAdminToken)
+	admin.Get("/op-catalog", handleOPCatalogStatus)
+	admin.Post("/op-catalog/refresh", handleOPCatalogRefresh)
+}
+
+func requireAdminToken(c *fiber.Ctx) error {
+	token := getBearerToken(c.Get(fiber.HeaderAuthorization))
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.Get().Server.AdminToken)) != 1 {
+		log.WithField("ip", c.IP()).Info("Rejected admin request")
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="admin"`)
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+	return c.Next()
+}
+
+type opCatalogStatus struct {
+	*opcatalog.Snapshot
+	OPs        int  `json:"ops"`
+	Refreshing bool `json:"refreshing"`
+}
+
+func handleOPCatalogStatus(c *fiber.Ctx) error {
+	s := opCatalog.Snapshot()
+	return c.JSON(
+		opCatalogStatus{
+			Snapshot:   s,
+			OPs:        len(s.OPs),
+			Refreshing: opCatalog.Refreshing(),
+		},
+	)
+}
+
+func handleOPCatalogRefresh(c *fiber.Ctx) error {
+	if !opCatalog.RefreshAsync() {
+		return c.Status(fiber.StatusConflict).JSON(
+			fiber.Map{
+				"error":             "conflict",
+				"error_description": "op collection already in progress",
+			},
+		)
+	}
+	log.Info("OP catalog refresh triggered by admin")
+	return c.SendStatus(fiber.StatusAccepted)
+}
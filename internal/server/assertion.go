@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/offa/internal"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func addAssertionEndpoints(s fiber.Router) {
+	s.Get("/.well-known/jwks.json", handleAssertionJWKS)
+}
+
+// handleAssertionJWKS publishes the public key that is used to sign
+// assertions, so that upstream applications can verify them
+func handleAssertionJWKS(c *fiber.Ctx) error {
+	data, err := json.Marshal(internal.GetJWKS(internal.AssertionSigningKeyName))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	c.Set(fiber.HeaderContentType, "application/jwk-set+json")
+	return c.Send(data)
+}
+
+// createAssertion creates a signed jwt that asserts the user's identity to
+// the protected host. The jwt contains the configured user claims, is
+// issued by OFFA, and includes the issuing OP as op_iss.
+func createAssertion(rule *config.AuthRule, host string, userInfos model.UserClaims) (string, error) {
+	claims := make(map[string]any, len(rule.Assertion.Claims)+6)
+	for _, claim := range rule.Assertion.Claims {
+		if v, ok := userInfos.Get(claim); ok {
+			claims[string(claim)] = v
+		}
+	}
+	jti, err := internal.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims["iss"] = config.Get().Federation.EntityID
+	claims["aud"] = host
+	claims["op_iss"], _ = userInfos.GetString("iss")
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Duration(rule.Assertion.Lifetime) * time.Second).Unix()
+	claims["jti"] = jti
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	signed, err := internal.SignJWT(internal.AssertionSigningKeyName, payload)
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
@@ -1,19 +1,26 @@
 package server
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/go-oidfed/lib"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/go-oidfed/offa/internal"
 	"github.com/go-oidfed/offa/internal/cache"
 	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/expr"
 	"github.com/go-oidfed/offa/internal/model"
 )
 
@@ -21,6 +28,12 @@ func isTrustedIP(ipStr string) bool {
 	if len(config.Get().Server.TrustedNets) == 0 {
 		return true
 	}
+	return isTrustedProxy(ipStr)
+}
+
+// isTrustedProxy checks if the passed ip is in one of the configured
+// trusted proxy networks
+func isTrustedProxy(ipStr string) bool {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return false
@@ -54,59 +67,268 @@ func addAuthHandlers(s fiber.Router) {
 				return c.Status(fiber.StatusForbidden).SendString("Forbidden: Untrusted Proxy")
 			}
 
-			forHost := c.Get(fiber.HeaderXForwardedHost)
-			forPath := c.Get("X-Forwarded-Uri")
+			host, uri, method, proto := forwardedRequest(c)
+			req := authRequest{
+				Host:          host,
+				Path:          uri,
+				Method:        method,
+				Scheme:        proto,
+				ClientIP:      getClientIP(c),
+				SessionID:     c.Cookies(config.Get().SessionStorage.CookieName),
+				BearerToken:   getBearerToken(c.Get(fiber.HeaderAuthorization)),
+				Accept:        c.Get(fiber.HeaderAccept),
+				RequestedWith: c.Get(fiber.HeaderXRequestedWith),
+			}
+			return writeAuthResponse(c, authorize(req))
+		},
+	)
+}
 
-			var rule *config.AuthRule
-			if forHost == "" && forPath == "/" {
-				rule = &config.AuthRule{
-					ForwardHeadersPrefix: "OIDC",
-				}
-			} else {
-				if len(config.Get().Auth) == 0 {
-					return c.Status(fiber.StatusForbidden).SendString("Forbidden")
-				}
-				rule = config.Get().Auth.FindRule(forHost, forPath)
+// authRequest holds the attributes of a request that should be authorized,
+// independent of the protocol it was received with
+type authRequest struct {
+	Host          string
+	Path          string
+	Method        string
+	Scheme        string
+	ClientIP      string
+	SessionID     string
+	BearerToken   string
+	Accept        string
+	RequestedWith string
+	// Preview marks requests that are only made to show the effective
+	// result to the user; no assertion is created for them
+	Preview bool
+}
+
+// authResponse is the protocol independent result of an authRequest
+type authResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    string
+	// Rule is the matched AuthRule of an allowed request
+	Rule *config.AuthRule
+}
+
+// Allowed checks if the request was authorized
+func (r authResponse) Allowed() bool {
+	return r.Status == fiber.StatusOK
+}
+
+func writeAuthResponse(c *fiber.Ctx, res authResponse) error {
+	for k, v := range res.Headers {
+		c.Set(k, v)
+	}
+	if res.Body == "" {
+		return c.SendStatus(res.Status)
+	}
+	return c.Status(res.Status).SendString(res.Body)
+}
+
+// authorize finds the AuthRule for the request, authenticates the user
+// either by session or bearer token, and checks if the user fulfills the
+// rule's requirements
+func authorize(req authRequest) authResponse {
+	var rule *config.AuthRule
+	var captures config.Captures
+	if req.Host == "" && req.Path == "/" {
+		rule = &config.AuthRule{
+			ForwardHeadersPrefix: "OIDC",
+		}
+	} else {
+		if len(config.Get().Auth) == 0 {
+			return forbidden(req, nil, "no matching auth rule")
+		}
+		rule, captures = config.Get().Auth.FindRule(req.Host, req.Path, req.Method, req.ClientIP)
+	}
+	if rule == nil {
+		return forbidden(req, nil, "no matching auth rule")
+	}
+	if rule.Action == config.AuthActionDeny {
+		return forbidden(req, rule, "denied by auth rule")
+	}
+	anonymous := authResponse{
+		Status: fiber.StatusOK,
+		Rule:   rule,
+	}
+
+	var userInfos model.UserClaims
+	if rule.Bearer.Enabled && req.BearerToken != "" {
+		var err error
+		userInfos, err = validateBearerToken(req.BearerToken, rule, req.Host)
+		if err != nil {
+			log.WithError(err).Info("Invalid bearer token")
+			if rule.Anonymous {
+				return anonymous
 			}
-			if rule == nil {
-				return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+			return invalidBearerToken(err)
+		}
+	} else {
+		if req.SessionID == "" {
+			if rule.Anonymous {
+				return anonymous
 			}
+			return redirectNext(req, rule)
+		}
 
-			sessionToken := c.Cookies(config.Get().SessionStorage.CookieName)
-			if sessionToken == "" {
-				return redirectNext(c, forHost, forPath, rule.RedirectStatusCode)
+		var err error
+		userInfos, err = validateSession(req.SessionID)
+		if err != nil || userInfos == nil {
+			if err != nil {
+				log.WithError(err).Info("Invalid session")
 			}
-
-			userInfos, err := validateSession(sessionToken)
-			if err != nil || userInfos == nil {
-				if err != nil {
-					log.WithError(err).Info("Invalid session")
-				}
-				return redirectNext(c, forHost, forPath, rule.RedirectStatusCode)
+			if rule.Anonymous {
+				return anonymous
 			}
+			return redirectNext(req, rule)
+		}
+	}
+
+	log.Debugf("auth request Userclaims are: %+v", userInfos)
 
-			log.Debugf("auth request Userclaims are: %+v", userInfos)
+	if iss, _ := userInfos.GetString("iss"); !ruleOPRestriction(rule).allows(iss) {
+		log.WithField("iss", iss).Info("OP not allowed by auth rule")
+		switch {
+		case rule.Anonymous:
+			return anonymous
+		case rule.Bearer.Enabled && req.BearerToken != "":
+			return invalidBearerToken(errors.New("token issuer not allowed"))
+		default:
+			// The user might have another account at an allowed OP
+			return redirectNext(req, rule)
+		}
+	}
 
-			if !verifyUser(userInfos, rule.Require) {
-				return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+	reqAttrs := expr.Request{
+		Host:     req.Host,
+		Path:     req.Path,
+		Method:   req.Method,
+		ClientIP: req.ClientIP,
+		Captures: captures,
+	}
+	if !verifyUser(userInfos, rule, reqAttrs) {
+		if rule.Anonymous {
+			// The user may access anonymously, but since the
+			// requirements are not met, no user information is
+			// forwarded
+			return anonymous
+		}
+		return forbidden(req, rule, "requirements not fulfilled")
+	}
+
+	headers, err := forwardHeaders(rule, userInfos, captures)
+	if err != nil {
+		log.WithError(err).Error("failed to forward headers")
+		return authResponse{
+			Status: fiber.StatusInternalServerError,
+			Body:   "Internal Server Error",
+		}
+	}
+	if rule.Assertion.Enabled && !req.Preview {
+		assertion, err := createAssertion(rule, req.Host, userInfos)
+		if err != nil {
+			log.WithError(err).Error("failed to create assertion")
+			return authResponse{
+				Status: fiber.StatusInternalServerError,
+				Body:   "Internal Server Error",
 			}
+		}
+		headers[rule.Assertion.Header] = assertion
+	}
+	return authResponse{
+		Status:  fiber.StatusOK,
+		Headers: headers,
+		Rule:    rule,
+	}
+}
 
-			setHeaders(c, rule.ForwardHeadersPrefix, rule.ForwardHeaders, userInfos)
+// getHeader returns the value of the header with the passed name or an empty
+// string if no name is passed
+func getHeader(c *fiber.Ctx, name string) string {
+	if name == "" {
+		return ""
+	}
+	return c.Get(name)
+}
 
-			return c.SendStatus(fiber.StatusOK)
-		},
-	)
+// forwardedRequest returns the attributes of the original request as sent by
+// the reverse proxy in the configured forwarded headers. Values from the url
+// header take precedence over the single headers.
+func forwardedRequest(c *fiber.Ctx) (host, uri, method, proto string) {
+	headers := config.Get().Server.ForwardedHeaders
+	if originalURL := getHeader(c, headers.URL); originalURL != "" {
+		if u, err := url.Parse(originalURL); err == nil && u.Host != "" {
+			host = u.Host
+			uri = u.RequestURI()
+			proto = u.Scheme
+		}
+	}
+	if host == "" {
+		host = getHeader(c, headers.Host)
+	}
+	if uri == "" {
+		uri = getHeader(c, headers.URI)
+	}
+	if proto == "" {
+		proto = getHeader(c, headers.Proto)
+	}
+	method = getHeader(c, headers.Method)
+	return
 }
 
-func verifyUser(
+// getClientIP returns the ip of the user's client as reported by the proxy in
+// the configured client ip header (by default X-Forwarded-For). This is the
+// right-most entry that is not a trusted proxy, since entries left of it
+// could be set by the client.
+func getClientIP(c *fiber.Ctx) string {
+	value := getHeader(c, config.Get().Server.ForwardedHeaders.ClientIP)
+	if value == "" {
+		return c.IP()
+	}
+	ips := strings.Split(value, ",")
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(ips[i])
+		if i == 0 || !isTrustedProxy(ip) {
+			return ip
+		}
+	}
+	return c.IP()
+}
+
+// verifyUser checks if the user fulfills the requirements of the AuthRule,
+// i.e. the require options and the require_expr expression
+func verifyUser(claims model.UserClaims, rule *config.AuthRule, req expr.Request) bool {
+	if !verifyRequire(claims, rule.Require, req.Captures) {
+		return false
+	}
+	if rule.RequireProgram == nil {
+		return true
+	}
+	ok, err := rule.RequireProgram.Evaluate(claims, req)
+	if err != nil {
+		log.WithError(err).WithField("expr", rule.RequireProgram.String()).Info("Error evaluating require_expr")
+		return false
+	}
+	return ok
+}
+
+// verifyRequire checks if the user fulfills at least one of the require
+// options; placeholders in the required values are replaced with the passed
+// captures
+func verifyRequire(
 	claims model.UserClaims, require oidfed.SliceOrSingleValue[map[model.Claim]oidfed.SliceOrSingleValue[string]],
+	captures config.Captures,
 ) bool {
 	if len(require) == 0 {
 		return true
 	}
 	for _, options := range require {
 		var optionFailed bool
-		for claim, claimRequires := range options {
+		for claim, values := range options {
+			claimRequires := make([]string, len(values))
+			for i, v := range values {
+				claimRequires[i] = captures.Expand(v)
+			}
 			claimValue, ok := claims.GetString(claim)
 			if ok {
 				// string claim
@@ -139,57 +361,294 @@ func verifyUser(
 	return false
 }
 
-func setHeaders(
-	c *fiber.Ctx, headerPrefix string, headerClaims map[string]oidfed.SliceOrSingleValue[model.Claim],
-	userInfos model.UserClaims,
+// forwardHeaders returns the headers that should be forwarded for the
+// AuthRule. The headers of the rule's preset are set first, then the
+// headers with the configured prefix, the rule's forward_headers, and
+// finally the header templates.
+func forwardHeaders(rule *config.AuthRule, userInfos model.UserClaims, captures config.Captures) (
+	map[string]string, error,
 ) {
-	if headerClaims == nil && headerPrefix == "" {
+	headers := make(map[string]string)
+	headerClaims := rule.ForwardHeaders
+	if headerClaims == nil && rule.ForwardHeadersPrefix == "" && rule.ForwardHeadersPreset == "" {
 		headerClaims = config.DefaultForwardHeaders
 	}
-	if headerPrefix != "" {
+	addPresetHeaders(headers, rule, userInfos)
+	if rule.ForwardHeadersPrefix != "" {
 		for claim := range userInfos {
+			if !rule.ForwardsClaim(claim) {
+				continue
+			}
 			value, ok := userInfos.GetForHeader(claim)
 			if !ok {
 				continue
 			}
-			c.Set(fmt.Sprintf("%s-%s", headerPrefix, strings.ToTitle(string(claim))), value)
+			header := fmt.Sprintf("%s-%s", rule.ForwardHeadersPrefix, strings.ToTitle(string(claim)))
+			headers[sanitizeHeaderName(header)] = value
+		}
+	}
+	addClaimHeaders(headers, headerClaims, userInfos, captures)
+	for header, t := range rule.HeaderTemplatesTmpl {
+		value, err := t.Execute(userInfos, captures)
+		if err != nil {
+			log.WithError(err).WithField("header", header).Info("Error executing header template")
+			continue
+		}
+		if value != "" {
+			headers[header] = value
+		}
+	}
+	if err := limitHeaderSizes(headers, rule.MaxHeaderSize, rule.HeaderSizePolicy); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// forwardHeaderNames returns the names of the headers that forwardHeaders
+// can set for the AuthRule and the prefixes of headers that are named after
+// claims
+func forwardHeaderNames(rule *config.AuthRule) (names, prefixes []string) {
+	headerClaims := rule.ForwardHeaders
+	if headerClaims == nil && rule.ForwardHeadersPrefix == "" && rule.ForwardHeadersPreset == "" {
+		headerClaims = config.DefaultForwardHeaders
+	}
+	switch preset := rule.ForwardHeadersPreset; preset {
+	case "":
+	case config.ForwardHeadersPresetModAuthOpenIDC:
+		prefixes = append(prefixes, "OIDC_CLAIM_")
+	case config.ForwardHeadersPresetBasic:
+		names = append(names, fiber.HeaderAuthorization)
+	default:
+		names = slices.AppendSeq(names, maps.Keys(config.ForwardHeadersPresets[preset]))
+	}
+	if rule.ForwardHeadersPrefix != "" {
+		prefixes = append(prefixes, sanitizeHeaderName(rule.ForwardHeadersPrefix+"-"))
+	}
+	names = slices.AppendSeq(names, maps.Keys(headerClaims))
+	names = slices.AppendSeq(names, maps.Keys(rule.HeaderTemplates))
+	if rule.Assertion.Enabled {
+		names = append(names, rule.Assertion.Header)
+	}
+	return
+}
+
+// headersToRemove returns the lowercase names of the headers the matched
+// AuthRule of an allowed request can forward, but which are not set in the
+// response. These could otherwise be sent by the client and reach the
+// upstream, if the proxy only adds the response headers to the upstream
+// request. Headers named after claims can only be found in the passed
+// request headers.
+func headersToRemove(res authResponse, requestHeaders []string) []string {
+	if !res.Allowed() || res.Rule == nil {
+		return nil
+	}
+	names, prefixes := forwardHeaderNames(res.Rule)
+	for _, header := range requestHeaders {
+		for _, prefix := range prefixes {
+			if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+				names = append(names, header)
+				break
+			}
+		}
+	}
+	set := make(map[string]bool, len(res.Headers))
+	for header := range res.Headers {
+		set[strings.ToLower(header)] = true
+	}
+	var remove []string
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !set[name] && !slices.Contains(remove, name) {
+			remove = append(remove, name)
+		}
+	}
+	slices.Sort(remove)
+	return remove
+}
+
+// limitHeaderSizes applies the header size policy to all header values that
+// are larger than maxSize bytes; a maxSize of 0 means unlimited
+func limitHeaderSizes(headers map[string]string, maxSize int, policy string) error {
+	if maxSize == 0 {
+		return nil
+	}
+	for header, value := range headers {
+		if len(value) <= maxSize {
+			continue
+		}
+		switch policy {
+		case config.HeaderSizePolicyTruncate:
+			cut := maxSize
+			for cut > 0 && !utf8.RuneStart(value[cut]) {
+				cut--
+			}
+			headers[header] = value[:cut]
+		case config.HeaderSizePolicyFail:
+			return errors.Errorf("value of header '%s' exceeds the maximum size of %d bytes", header, maxSize)
+		default:
+			log.WithField("header", header).Info("Dropping header exceeding the maximum size")
+			delete(headers, header)
+		}
+	}
+	return nil
+}
+
+// addPresetHeaders adds the headers of a forward headers preset
+func addPresetHeaders(headers map[string]string, rule *config.AuthRule, userInfos model.UserClaims) {
+	switch preset := rule.ForwardHeadersPreset; preset {
+	case "":
+	case config.ForwardHeadersPresetModAuthOpenIDC:
+		for claim := range userInfos {
+			if !rule.ForwardsClaim(claim) {
+				continue
+			}
+			if value, ok := userInfos.GetForHeader(claim); ok {
+				headers[sanitizeHeaderName("OIDC_CLAIM_"+string(claim))] = value
+			}
+		}
+	case config.ForwardHeadersPresetBasic:
+		user, ok := userInfos.GetString("preferred_username")
+		if !ok {
+			user, _ = userInfos.GetString("sub")
 		}
+		if user != "" {
+			headers[fiber.HeaderAuthorization] = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"))
+		}
+	default:
+		addClaimHeaders(headers, config.ForwardHeadersPresets[preset], userInfos, nil)
 	}
+}
+
+// sanitizeHeaderName replaces all characters that are not allowed in http
+// header names (RFC 9110 token characters) with '_', since header names
+// built from claim names could otherwise be invalid or be used to inject
+// headers
+func sanitizeHeaderName(name string) string {
+	return strings.Map(
+		func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+				return r
+			case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+				return r
+			default:
+				return '_'
+			}
+		}, name,
+	)
+}
+
+// addClaimHeaders adds the headers for the passed header to claims mapping;
+// an entry for a header that contains a placeholder is expanded with the
+// passed captures instead of being looked up as claim
+func addClaimHeaders(
+	headers map[string]string, headerClaims map[string]oidfed.SliceOrSingleValue[model.Claim],
+	userInfos model.UserClaims, captures config.Captures,
+) {
 	for header, claim := range headerClaims {
 		var value string
 		var ok bool
 		for _, cl := range claim {
-			value, ok = userInfos.GetForHeader(cl)
+			if len(config.PlaceholderNames(string(cl))) > 0 {
+				value = captures.Expand(string(cl))
+				ok = value != ""
+			} else {
+				value, ok = userInfos.GetForHeader(cl)
+			}
 			if ok {
 				break
 			}
 		}
 		if value != "" {
-			c.Set(header, value)
+			headers[header] = value
 		}
 	}
 }
 
 func validateSession(sessionKey string) (claims model.UserClaims, err error) {
+	var session model.Session
 	var found bool
-	found, err = cache.GetSession(sessionKey, &claims)
-	if !found {
-		claims = nil
+	found, err = cache.GetSession(sessionKey, &session)
+	if err != nil || !found {
+		return
 	}
+	session, err = refreshSession(sessionKey, session)
+	if err != nil {
+		return
+	}
+	claims = session.Claims
 	return
 }
 
-func redirectNext(c *fiber.Ctx, forHost, forPath string, ruleRedirectStatusCode int) error {
-	next := url.URL{
-		Scheme: c.Get(fiber.HeaderXForwardedProto),
-		Host:   forHost,
-		Path:   forPath,
+// wantsJSON checks if the client expects a json response instead of a
+// redirect or html, i.e. if it is an api or XHR client
+func wantsJSON(req authRequest, rule *config.AuthRule) bool {
+	if rule != nil && rule.API {
+		return true
+	}
+	return strings.Contains(req.Accept, fiber.MIMEApplicationJSON) || req.RequestedWith == "XMLHttpRequest"
+}
+
+func jsonResponse(status int, body fiber.Map, headers map[string]string) authResponse {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.WithError(err).Error("failed to encode json response")
 	}
-	st := ruleRedirectStatusCode
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[fiber.HeaderContentType] = fiber.MIMEApplicationJSON
+	return authResponse{
+		Status:  status,
+		Headers: headers,
+		Body:    string(data),
+	}
+}
+
+// forbidden returns a 403 response; api clients receive the reason as json
+func forbidden(req authRequest, rule *config.AuthRule, reason string) authResponse {
+	if wantsJSON(req, rule) {
+		return jsonResponse(
+			fiber.StatusForbidden, fiber.Map{
+				"error":             "forbidden",
+				"error_description": reason,
+			}, nil,
+		)
+	}
+	return authResponse{
+		Status: fiber.StatusForbidden,
+		Body:   "Forbidden",
+	}
+}
+
+// redirectNext returns a redirect to the login page; api clients receive a
+// 401 response with the login url instead
+func redirectNext(req authRequest, rule *config.AuthRule) authResponse {
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	q := url.Values{}
+	q.Set("next", fmt.Sprintf("%s://%s%s", scheme, req.Host, req.Path))
+	ruleOPRestriction(rule).addToQuery(q)
+	loginURL := fullLoginPath + "?" + q.Encode()
+	if wantsJSON(req, rule) {
+		return jsonResponse(
+			fiber.StatusUnauthorized, fiber.Map{
+				"error":             "unauthorized",
+				"error_description": "login required",
+				"login_url":         loginURL,
+			}, map[string]string{
+				fiber.HeaderWWWAuthenticate: fmt.Sprintf(`Bearer realm="%s"`, config.Get().Federation.EntityID),
+			},
+		)
+	}
+	st := rule.RedirectStatusCode
 	if st == 0 {
 		st = http.StatusSeeOther
 	}
-	return c.Redirect(
-		fmt.Sprintf("%s?next=%s", fullLoginPath, next.String()), st,
-	)
+	return authResponse{
+		Status:  st,
+		Headers: map[string]string{fiber.HeaderLocation: loginURL},
+	}
 }
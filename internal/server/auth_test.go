@@ -0,0 +1,406 @@
+package server
+
+import (
+	"encoding/json"
+	"maps"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func TestSanitizeHeaderName(t *testing.T) {
+	tests := map[string]string{
+		"OIDC_CLAIM_email":               "OIDC_CLAIM_email",
+		"OIDC_CLAIM_https://example.org": "OIDC_CLAIM_https___example.org",
+		"OIDC_CLAIM_a b":                 "OIDC_CLAIM_a_b",
+		"OIDC_CLAIM_x\r\nX-Injected: 1":  "OIDC_CLAIM_x__X-Injected__1",
+		"OIDC-CLAIM-ÄÖ":                  "OIDC-CLAIM-__",
+	}
+	for name, expected := range tests {
+		if got := sanitizeHeaderName(name); got != expected {
+			t.Errorf("sanitizeHeaderName(%q): expected %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestForwardHeadersModAuthOpenIDC(t *testing.T) {
+	claims := model.UserClaims{
+		"sub":                    "user",
+		"email":                  "user@example.org",
+		"email_verified":         true,
+		"https://example.org/id": "42",
+	}
+	tests := []struct {
+		name     string
+		include  []string
+		exclude  []string
+		expected map[string]string
+	}{
+		{
+			name: "all claims",
+			expected: map[string]string{
+				"OIDC_CLAIM_sub":                    "user",
+				"OIDC_CLAIM_email":                  "user@example.org",
+				"OIDC_CLAIM_email_verified":         "true",
+				"OIDC_CLAIM_https___example.org_id": "42",
+			},
+		},
+		{
+			name:    "include",
+			include: []string{"email*"},
+			expected: map[string]string{
+				"OIDC_CLAIM_email":          "user@example.org",
+				"OIDC_CLAIM_email_verified": "true",
+			},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"email*", "sub"},
+			exclude: []string{"*_verified"},
+			expected: map[string]string{
+				"OIDC_CLAIM_sub":   "user",
+				"OIDC_CLAIM_email": "user@example.org",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				rule := &config.AuthRule{
+					ForwardHeadersPreset: config.ForwardHeadersPresetModAuthOpenIDC,
+					ForwardClaimsInclude: test.include,
+					ForwardClaimsExclude: test.exclude,
+				}
+				headers, err := forwardHeaders(rule, claims, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !maps.Equal(headers, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, headers)
+				}
+			},
+		)
+	}
+}
+
+func TestLimitHeaderSizes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int
+		policy   string
+		expected map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "no limit",
+			policy:   config.HeaderSizePolicyDrop,
+			expected: map[string]string{"X-Short": "abc", "X-Long": "abcdéf"},
+		},
+		{
+			name:     "drop",
+			maxSize:  4,
+			policy:   config.HeaderSizePolicyDrop,
+			expected: map[string]string{"X-Short": "abc"},
+		},
+		{
+			name:     "truncate at rune boundary",
+			maxSize:  5,
+			policy:   config.HeaderSizePolicyTruncate,
+			expected: map[string]string{"X-Short": "abc", "X-Long": "abcd"},
+		},
+		{
+			name:     "truncate after rune",
+			maxSize:  6,
+			policy:   config.HeaderSizePolicyTruncate,
+			expected: map[string]string{"X-Short": "abc", "X-Long": "abcdé"},
+		},
+		{
+			name:    "fail",
+			maxSize: 4,
+			policy:  config.HeaderSizePolicyFail,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				headers := map[string]string{"X-Short": "abc", "X-Long": "abcdéf"}
+				err := limitHeaderSizes(headers, test.maxSize, test.policy)
+				if test.wantErr {
+					if err == nil {
+						t.Fatal("expected error")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !maps.Equal(headers, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, headers)
+				}
+			},
+		)
+	}
+}
+
+func TestAuthorizeAnonymous(t *testing.T) {
+	allowedOP := newTestOP(t, "https://op-allowed.example.org")
+	otherOP := newTestOP(t, "https://op-other.example.org")
+	now := time.Now()
+	newSession := func(t *testing.T, iss, group string) string {
+		t.Helper()
+		sessionID := "anonymous-" + strings.TrimPrefix(iss, "https://") + "-" + group
+		err := cache.SetSession(
+			sessionID, model.Session{
+				Claims: model.UserClaims{
+					"iss":                iss,
+					"sub":                "user",
+					"preferred_username": "jane",
+					"groups":             []any{group},
+				},
+				ExpiresAt: now.Add(time.Hour),
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sessionID
+	}
+	accessToken := func(op *testOP, group string) string {
+		return op.sign(
+			t, "at+jwt", map[string]any{
+				"iss":                op.issuer,
+				"sub":                "user",
+				"aud":                testEntityID,
+				"client_id":          "client",
+				"exp":                now.Add(time.Hour).Unix(),
+				"iat":                now.Unix(),
+				"preferred_username": "jane",
+				"groups":             []string{group},
+			},
+		)
+	}
+	authenticated := map[string]string{"X-Forwarded-User": "jane"}
+	tests := []struct {
+		name     string
+		req      authRequest
+		expected map[string]string
+	}{
+		{
+			name: "no session",
+		},
+		{
+			name: "invalid session",
+			req:  authRequest{SessionID: "unknown-session"},
+		},
+		{
+			name:     "valid session",
+			req:      authRequest{SessionID: newSession(t, allowedOP.issuer, "staff")},
+			expected: authenticated,
+		},
+		{
+			name: "session at op not allowed",
+			req:  authRequest{SessionID: newSession(t, otherOP.issuer, "staff")},
+		},
+		{
+			name: "session not fulfilling requirements",
+			req:  authRequest{SessionID: newSession(t, allowedOP.issuer, "users")},
+		},
+		{
+			name: "invalid bearer token",
+			req:  authRequest{BearerToken: "not-a-jwt"},
+		},
+		{
+			name:     "valid bearer token",
+			req:      authRequest{BearerToken: accessToken(allowedOP, "staff")},
+			expected: authenticated,
+		},
+		{
+			name: "bearer token from op not allowed",
+			req:  authRequest{BearerToken: accessToken(otherOP, "staff")},
+		},
+		{
+			name: "bearer token not fulfilling requirements",
+			req:  authRequest{BearerToken: accessToken(allowedOP, "users")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				req := test.req
+				req.Host = "anonymous.example.com"
+				req.Path = "/"
+				req.Method = "GET"
+				res := authorize(req)
+				if res.Status != fiber.StatusOK {
+					t.Fatalf("expected status %d, got %d", fiber.StatusOK, res.Status)
+				}
+				if len(res.Headers) != len(test.expected) || !maps.Equal(res.Headers, test.expected) {
+					t.Errorf("expected headers %v, got %v", test.expected, res.Headers)
+				}
+			},
+		)
+	}
+}
+
+func TestAuthorizeResponses(t *testing.T) {
+	oldLoginPath := fullLoginPath
+	fullLoginPath = testEntityID + "/login"
+	t.Cleanup(func() { fullLoginPath = oldLoginPath })
+	sessionID := "responses-session"
+	err := cache.SetSession(
+		sessionID, model.Session{
+			Claims: model.UserClaims{
+				"iss":    "https://op.example.org",
+				"sub":    "user",
+				"groups": []any{"users"},
+			},
+			ExpiresAt: time.Now().Add(time.Hour),
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginURL := func(host string) string {
+		return fullLoginPath + "?" + url.Values{"next": {"https://" + host + "/page?x=1"}}.Encode()
+	}
+	const (
+		browserAccept = "text/html,application/xhtml+xml,*/*;q=0.8"
+		realm         = `Bearer realm="` + testEntityID + `"`
+	)
+	tests := []struct {
+		name          string
+		req           authRequest
+		status        int
+		location      string
+		jsonBody      map[string]string
+		plainBody     string
+		wwwAuthHeader string
+	}{
+		{
+			name:     "browser login redirect",
+			req:      authRequest{Host: "app.example.com", Accept: browserAccept},
+			status:   fiber.StatusFound,
+			location: loginURL("app.example.com"),
+		},
+		{
+			name:   "json client login required",
+			req:    authRequest{Host: "app.example.com", Accept: fiber.MIMEApplicationJSON},
+			status: fiber.StatusUnauthorized,
+			jsonBody: map[string]string{
+				"error":             "unauthorized",
+				"error_description": "login required",
+				"login_url":         loginURL("app.example.com"),
+			},
+			wwwAuthHeader: realm,
+		},
+		{
+			name:   "xhr client login required",
+			req:    authRequest{Host: "app.example.com", Accept: browserAccept, RequestedWith: "XMLHttpRequest"},
+			status: fiber.StatusUnauthorized,
+			jsonBody: map[string]string{
+				"error":             "unauthorized",
+				"error_description": "login required",
+				"login_url":         loginURL("app.example.com"),
+			},
+			wwwAuthHeader: realm,
+		},
+		{
+			name:   "api rule login required",
+			req:    authRequest{Host: "api.example.com", Accept: browserAccept},
+			status: fiber.StatusUnauthorized,
+			jsonBody: map[string]string{
+				"error":             "unauthorized",
+				"error_description": "login required",
+				"login_url":         loginURL("api.example.com"),
+			},
+			wwwAuthHeader: realm,
+		},
+		{
+			name:      "browser forbidden",
+			req:       authRequest{Host: "app.example.com", Accept: browserAccept, SessionID: sessionID},
+			status:    fiber.StatusForbidden,
+			plainBody: "Forbidden",
+		},
+		{
+			name:   "json client forbidden",
+			req:    authRequest{Host: "app.example.com", Accept: fiber.MIMEApplicationJSON, SessionID: sessionID},
+			status: fiber.StatusForbidden,
+			jsonBody: map[string]string{
+				"error":             "forbidden",
+				"error_description": "requirements not fulfilled",
+			},
+		},
+		{
+			name:   "api rule forbidden",
+			req:    authRequest{Host: "api.example.com", Accept: browserAccept, SessionID: sessionID},
+			status: fiber.StatusForbidden,
+			jsonBody: map[string]string{
+				"error":             "forbidden",
+				"error_description": "requirements not fulfilled",
+			},
+		},
+		{
+			name:   "json client without matching rule",
+			req:    authRequest{Host: "unknown.example.com", Accept: fiber.MIMEApplicationJSON},
+			status: fiber.StatusForbidden,
+			jsonBody: map[string]string{
+				"error":             "forbidden",
+				"error_description": "no matching auth rule",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				req := test.req
+				req.Path = "/page?x=1"
+				req.Method = "GET"
+				req.Scheme = "https"
+				res := authorize(req)
+				if res.Status != test.status {
+					t.Fatalf("expected status %d, got %d", test.status, res.Status)
+				}
+				if location := res.Headers[fiber.HeaderLocation]; location != test.location {
+					t.Errorf("expected location '%s', got '%s'", test.location, location)
+				}
+				if header := res.Headers[fiber.HeaderWWWAuthenticate]; header != test.wwwAuthHeader {
+					t.Errorf("expected WWW-Authenticate '%s', got '%s'", test.wwwAuthHeader, header)
+				}
+				if test.jsonBody == nil {
+					if res.Body != test.plainBody {
+						t.Errorf("expected body '%s', got '%s'", test.plainBody, res.Body)
+					}
+					return
+				}
+				if contentType := res.Headers[fiber.HeaderContentType]; contentType != fiber.MIMEApplicationJSON {
+					t.Errorf("expected json content type, got '%s'", contentType)
+				}
+				var body map[string]string
+				if err := json.Unmarshal([]byte(res.Body), &body); err != nil {
+					t.Fatalf("invalid json body '%s': %v", res.Body, err)
+				}
+				if !maps.Equal(body, test.jsonBody) {
+					t.Errorf("expected body %v, got %v", test.jsonBody, body)
+				}
+			},
+		)
+	}
+}
+
+func TestRedirectNextDefaultStatus(t *testing.T) {
+	res := redirectNext(authRequest{Host: "example.com", Path: "/"}, &config.AuthRule{})
+	if res.Status != fiber.StatusSeeOther {
+		t.Errorf("expected status %d, got %d", fiber.StatusSeeOther, res.Status)
+	}
+	if res.Headers[fiber.HeaderLocation] == "" {
+		t.Error("expected location header")
+	}
+}
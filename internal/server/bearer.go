@@ -0,0 +1,261 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+// bearerTokenDefaultCacheLifetime is used for validated tokens that do not
+// have an expiration time
+const bearerTokenDefaultCacheLifetime = time.Minute
+
+const accessTokenType = "access token"
+
+// jwtAccessTokenType is the typ of JWT access tokens as defined in RFC 9068
+const jwtAccessTokenType = "at+jwt"
+
+// getBearerToken returns the bearer token from the value of an
+// Authorization header or an empty string if there is none
+func getBearerToken(auth string) string {
+	const prefix = "bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// invalidBearerToken returns a 401 response as defined in RFC 6750
+func invalidBearerToken(err error) authResponse {
+	description := err.Error()
+	var tokenErr tokenValidationError
+	if errors.As(err, &tokenErr) {
+		description = tokenErr.Reason
+	}
+	return jsonResponse(
+		fiber.StatusUnauthorized, fiber.Map{
+			"error":             "invalid_token",
+			"error_description": description,
+		}, map[string]string{
+			fiber.HeaderWWWAuthenticate: fmt.Sprintf(
+				`Bearer realm="%s", error="invalid_token", error_description="%s"`,
+				config.Get().Federation.EntityID, strings.ReplaceAll(description, `"`, `'`),
+			),
+		},
+	)
+}
+
+// validateBearerToken validates an access token for the passed AuthRule and
+// the requested host and returns its claims. JWT access tokens are verified
+// with the keys of the issuing OP, other tokens are introspected at the
+// rule's introspection issuer. Validated tokens are cached until they expire.
+func validateBearerToken(token string, rule *config.AuthRule, host string) (model.UserClaims, error) {
+	hash := sha256.Sum256([]byte(token))
+	key := base64.RawURLEncoding.EncodeToString(hash[:])
+	var claims model.UserClaims
+	found, err := cache.Get(cache.KeyBearer, key, &claims)
+	if err != nil {
+		log.WithError(err).Error("failed to obtain bearer token from cache")
+	}
+	if !found {
+		if isJWT(token) {
+			claims, err = verifyJWTAccessToken(token, rule.Bearer.Issuers)
+		} else {
+			claims, err = introspectToken(token, rule.Bearer.IntrospectionIssuer)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ttl := bearerTokenDefaultCacheLifetime
+		if exp, ok := claims.GetTime("exp"); ok {
+			ttl = time.Until(exp)
+		}
+		if ttl > 0 {
+			if err = cache.Set(cache.KeyBearer, key, claims, ttl); err != nil {
+				log.WithError(err).Error("failed to cache bearer token")
+			}
+		}
+	}
+	if err = checkBearerClaims(claims, rule, host); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// bearerAudiences returns the audiences accepted for the passed AuthRule and
+// host; if the rule does not configure audiences, tokens must be issued for
+// OFFA or the protected host
+func bearerAudiences(rule *config.AuthRule, host string) []string {
+	if len(rule.Bearer.Audiences) > 0 {
+		return rule.Bearer.Audiences
+	}
+	audiences := []string{config.Get().Federation.EntityID}
+	if host != "" {
+		audiences = append(audiences, "https://"+host, host)
+	}
+	return audiences
+}
+
+// checkBearerClaims checks the rule specific requirements for an already
+// validated access token
+func checkBearerClaims(claims model.UserClaims, rule *config.AuthRule, host string) error {
+	if err := checkTokenTimes(accessTokenType, claims, false); err != nil {
+		return err
+	}
+	if issuers := rule.Bearer.Issuers; len(issuers) > 0 {
+		if iss, _ := claims.GetString("iss"); !slices.Contains(issuers, iss) {
+			return newTokenValidationError("access token issuer not allowed", "token issued by "+iss)
+		}
+	}
+	audiences := bearerAudiences(rule, host)
+	aud := claims.GetAudience()
+	if !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(audiences, a) }) {
+		return newTokenValidationError(
+			accessTokenType+" audience mismatch", "token was not issued for this resource",
+		)
+	}
+	return nil
+}
+
+func isJWT(token string) bool {
+	if strings.Count(token, ".") != 2 {
+		return false
+	}
+	_, err := jws.ParseString(token)
+	return err == nil
+}
+
+// isAccessTokenType checks if the typ header of a JWT marks it as an
+// access token as defined in RFC 9068
+func isAccessTokenType(typ string) bool {
+	return strings.EqualFold(typ, jwtAccessTokenType) || strings.EqualFold(typ, "application/"+jwtAccessTokenType)
+}
+
+// verifyJWTAccessToken verifies a JWT access token as defined in RFC 9068
+// with the keys of the issuing OP as resolved through the federation. If
+// issuers are passed, tokens from other issuers are rejected before any
+// keys are resolved.
+func verifyJWTAccessToken(token string, issuers []string) (model.UserClaims, error) {
+	msg, err := jws.ParseString(token)
+	if err != nil {
+		return nil, newTokenValidationError("error parsing access token", err.Error())
+	}
+	var unverifiedClaims model.UserClaims
+	if err = json.Unmarshal(msg.Payload(), &unverifiedClaims); err != nil {
+		return nil, newTokenValidationError("error decoding access token", err.Error())
+	}
+	var typ string
+	if sigs := msg.Signatures(); len(sigs) > 0 && sigs[0].ProtectedHeaders() != nil {
+		typ, _ = sigs[0].ProtectedHeaders().Type()
+	}
+	if !isAccessTokenType(typ) {
+		_, hasNonce := unverifiedClaims["nonce"]
+		_, hasAZP := unverifiedClaims["azp"]
+		if hasNonce || hasAZP {
+			return nil, newTokenValidationError("invalid access token", "id tokens are not accepted")
+		}
+		return nil, newTokenValidationError("invalid access token", "token type must be "+jwtAccessTokenType)
+	}
+	if _, ok := unverifiedClaims["nonce"]; ok {
+		return nil, newTokenValidationError("invalid access token", "id tokens are not accepted")
+	}
+	iss, _ := unverifiedClaims.GetString("iss")
+	if iss == "" {
+		return nil, newTokenValidationError("invalid access token", "missing iss claim")
+	}
+	if len(issuers) > 0 && !slices.Contains(issuers, iss) {
+		return nil, newTokenValidationError("access token issuer not allowed", "token issued by "+iss)
+	}
+	payload, err := verifyOPSignedJWT(token, iss)
+	if err != nil {
+		return nil, newTokenValidationError("invalid access token signature", err.Error())
+	}
+	var claims model.UserClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, newTokenValidationError("error decoding access token", err.Error())
+	}
+	if err = checkTokenTimes(accessTokenType, claims, true); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// introspectToken introspects an opaque access token at the passed issuer.
+// Tokens are only sent to a single OP, so that they cannot leak to other
+// OPs.
+func introspectToken(token, issuer string) (model.UserClaims, error) {
+	if issuer == "" {
+		return nil, newTokenValidationError(
+			"invalid access token", "token is not a jwt and no introspection issuer is configured",
+		)
+	}
+	claims, err := introspectTokenAt(token, issuer)
+	if err != nil {
+		log.WithError(err).WithField("iss", issuer).Info("Token introspection failed")
+		return nil, newTokenValidationError("invalid access token", "token introspection failed")
+	}
+	if claims == nil {
+		return nil, newTokenValidationError("invalid access token", "token is not active")
+	}
+	return claims, nil
+}
+
+// introspectTokenAt introspects an access token at the introspection
+// endpoint of the passed OP authenticating with private_key_jwt. If the
+// token is not active nil is returned.
+func introspectTokenAt(token, issuer string) (model.UserClaims, error) {
+	opMetadata, err := federationLeafEntity.ResolveOPMetadata(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if opMetadata.IntrospectionEndpoint == "" {
+		return nil, errors.New("op does not have an introspection endpoint")
+	}
+	params, err := privateKeyJWTParams(opMetadata.IntrospectionEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("token", token)
+	params.Set("token_type_hint", "access_token")
+
+	res, err := httpClient.PostForm(opMetadata.IntrospectionEndpoint, params)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if res.StatusCode != fiber.StatusOK {
+		return nil, errors.Errorf("introspection endpoint returned status %d: %s", res.StatusCode, body)
+	}
+	var claims model.UserClaims
+	if err = json.Unmarshal(body, &claims); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if active, _ := claims.GetBool("active"); !active {
+		return nil, nil
+	}
+	delete(claims, "active")
+	if iss, ok := claims.GetString("iss"); !ok {
+		claims["iss"] = issuer
+	} else if iss != issuer {
+		return nil, errors.Errorf("introspection response issuer '%s' does not match op", iss)
+	}
+	return claims, nil
+}
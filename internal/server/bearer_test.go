@@ -0,0 +1,248 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jws"
+
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func signTestJWT(t *testing.T, typ string, claims map[string]any) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := jws.NewHeaders()
+	if typ != "" {
+		if err = headers.Set(jws.TypeKey, typ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := jws.Sign(payload, jws.WithKey(jwa.ES256(), key, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(token)
+}
+
+func assertTokenValidationError(t *testing.T, err error, message string) {
+	t.Helper()
+	var tokenErr tokenValidationError
+	if !errors.As(err, &tokenErr) {
+		t.Fatalf("expected token validation error, got %v", err)
+	}
+	if tokenErr.Message != message {
+		t.Errorf("expected message '%s', got '%s'", message, tokenErr.Message)
+	}
+}
+
+func TestVerifyJWTAccessTokenRejects(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name    string
+		typ     string
+		claims  map[string]any
+		issuers []string
+		message string
+	}{
+		{
+			name: "missing typ",
+			claims: map[string]any{
+				"iss": "https://op.example.org",
+				"exp": exp,
+			},
+			message: "token type must be at+jwt",
+		},
+		{
+			name: "jwt typ",
+			typ:  "JWT",
+			claims: map[string]any{
+				"iss": "https://op.example.org",
+				"exp": exp,
+			},
+			message: "token type must be at+jwt",
+		},
+		{
+			name: "id token with nonce",
+			claims: map[string]any{
+				"iss":   "https://op.example.org",
+				"exp":   exp,
+				"nonce": "n",
+			},
+			message: "id tokens are not accepted",
+		},
+		{
+			name: "id token with azp",
+			typ:  "JWT",
+			claims: map[string]any{
+				"iss": "https://op.example.org",
+				"exp": exp,
+				"azp": "client",
+			},
+			message: "id tokens are not accepted",
+		},
+		{
+			name: "at+jwt with nonce",
+			typ:  "at+jwt",
+			claims: map[string]any{
+				"iss":   "https://op.example.org",
+				"exp":   exp,
+				"nonce": "n",
+			},
+			message: "id tokens are not accepted",
+		},
+		{
+			name:    "missing iss",
+			typ:     "at+jwt",
+			claims:  map[string]any{"exp": exp},
+			message: "missing iss claim",
+		},
+		{
+			name: "issuer not allowed",
+			typ:  "application/at+jwt",
+			claims: map[string]any{
+				"iss": "https://evil.example.org",
+				"exp": exp,
+			},
+			issuers: []string{"https://op.example.org"},
+			message: "token issued by https://evil.example.org",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				token := signTestJWT(t, test.typ, test.claims)
+				_, err := verifyJWTAccessToken(token, test.issuers)
+				assertTokenValidationError(t, err, test.message)
+			},
+		)
+	}
+}
+
+func TestIntrospectTokenRequiresIssuer(t *testing.T) {
+	_, err := introspectToken("opaque", "")
+	assertTokenValidationError(t, err, "token is not a jwt and no introspection issuer is configured")
+}
+
+func TestCheckBearerClaims(t *testing.T) {
+	now := time.Now()
+	valid := func(aud any) model.UserClaims {
+		return model.UserClaims{
+			"iss": "https://op.example.org",
+			"aud": aud,
+			"exp": float64(now.Add(time.Hour).Unix()),
+		}
+	}
+	tests := []struct {
+		name      string
+		claims    model.UserClaims
+		issuers   []string
+		audiences []string
+		host      string
+		message   string
+	}{
+		{
+			name:   "default audience entity id",
+			claims: valid(testEntityID),
+			host:   "app.example.com",
+		},
+		{
+			name:   "default audience host",
+			claims: valid([]any{"https://app.example.com"}),
+			host:   "app.example.com",
+		},
+		{
+			name:    "default audience mismatch",
+			claims:  valid("https://other.example.com"),
+			host:    "app.example.com",
+			message: "token was not issued for this resource",
+		},
+		{
+			name:    "missing audience",
+			claims:  model.UserClaims{"iss": "https://op.example.org"},
+			host:    "app.example.com",
+			message: "token was not issued for this resource",
+		},
+		{
+			name:      "configured audience",
+			claims:    valid("api"),
+			audiences: []string{"api"},
+		},
+		{
+			name:      "configured audience replaces default",
+			claims:    valid(testEntityID),
+			audiences: []string{"api"},
+			message:   "token was not issued for this resource",
+		},
+		{
+			name:    "issuer not allowed",
+			claims:  valid(testEntityID),
+			issuers: []string{"https://other-op.example.org"},
+			message: "token issued by https://op.example.org",
+		},
+		{
+			name: "expired",
+			claims: model.UserClaims{
+				"iss": "https://op.example.org",
+				"aud": testEntityID,
+				"exp": float64(now.Add(-time.Hour).Unix()),
+			},
+			message: "token expired at " + time.Unix(now.Add(-time.Hour).Unix(), 0).String(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				rule := &config.AuthRule{}
+				rule.Bearer.Issuers = test.issuers
+				rule.Bearer.Audiences = test.audiences
+				err := checkBearerClaims(test.claims, rule, test.host)
+				if test.message == "" {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return
+				}
+				assertTokenValidationError(t, err, test.message)
+			},
+		)
+	}
+}
+
+func TestVerifyJWTAccessToken(t *testing.T) {
+	op := newTestOP(t, "https://op-access-token.example.org")
+	now := time.Now()
+	valid := map[string]any{
+		"iss":       op.issuer,
+		"sub":       "user",
+		"aud":       testEntityID,
+		"client_id": "client",
+		"exp":       now.Add(time.Hour).Unix(),
+		"iat":       now.Unix(),
+	}
+	claims, err := verifyJWTAccessToken(op.sign(t, "at+jwt", valid), []string{op.issuer})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sub, _ := claims.GetString("sub"); sub != "user" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+	_, err = verifyJWTAccessToken(
+		op.sign(t, "at+jwt", withClaims(valid, map[string]any{"exp": now.Add(-time.Hour).Unix()})), nil,
+	)
+	assertTokenValidationReason(t, err, "access token expired")
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"github.com/go-oidfed/offa/internal/config"
+)
+
+// headerEnvoyAuthHeadersToRemove is the response header in envoy's ext_authz
+// http mode that lists the headers envoy removes from the upstream request
+const headerEnvoyAuthHeadersToRemove = "X-Envoy-Auth-Headers-To-Remove"
+
+// addExtAuthzHandlers adds the handler for envoy's ext_authz http mode. In
+// this mode envoy sends the original request's method, host, and headers,
+// and appends the original path to the configured path prefix.
+func addExtAuthzHandlers(s fiber.Router) {
+	path := config.Get().Server.Paths.ExtAuthz
+	handler := func(c *fiber.Ctx) error {
+		clientIP := c.IP()
+		if !isTrustedIP(clientIP) {
+			log.WithField("ip", clientIP).Info("Blocked untrusted IP")
+			return c.Status(fiber.StatusForbidden).SendString("Forbidden: Untrusted Proxy")
+		}
+		originalPath := strings.TrimPrefix(string(c.Request().RequestURI()), path)
+		if !strings.HasPrefix(originalPath, "/") {
+			originalPath = "/" + originalPath
+		}
+		scheme := getHeader(c, config.Get().Server.ForwardedHeaders.Proto)
+		if scheme == "" {
+			scheme = c.Protocol()
+		}
+		req := authRequest{
+			Host:          c.Get(fiber.HeaderHost),
+			Path:          originalPath,
+			Method:        c.Method(),
+			Scheme:        scheme,
+			ClientIP:      getClientIP(c),
+			SessionID:     c.Cookies(config.Get().SessionStorage.CookieName),
+			BearerToken:   getBearerToken(c.Get(fiber.HeaderAuthorization)),
+			Accept:        c.Get(fiber.HeaderAccept),
+			RequestedWith: c.Get(fiber.HeaderXRequestedWith),
+		}
+		res := authorize(req)
+		if remove := headersToRemove(res, slices.Collect(maps.Keys(c.GetReqHeaders()))); len(remove) > 0 {
+			if res.Headers == nil {
+				res.Headers = make(map[string]string)
+			}
+			res.Headers[headerEnvoyAuthHeadersToRemove] = strings.Join(remove, ", ")
+		}
+		return writeAuthResponse(c, res)
+	}
+	s.All(path, handler)
+	s.All(path+"/*", handler)
+}
+
+// extAuthzServer implements envoy's ext_authz grpc service
+type extAuthzServer struct {
+	authv3.UnimplementedAuthorizationServer
+}
+
+func startExtAuthzGRPC(port int) {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.WithError(err).Fatal("could not start ext_authz grpc listener")
+	}
+	s := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(s, &extAuthzServer{})
+	log.WithField("port", port).Info("Starting ext_authz grpc server")
+	log.WithError(s.Serve(lis)).Fatal()
+}
+
+// Check implements the authv3.AuthorizationServer interface
+func (*extAuthzServer) Check(ctx context.Context, checkReq *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		if !isTrustedIP(host) {
+			log.WithField("ip", host).Info("Blocked untrusted IP")
+			return nil, grpcstatus.Error(codes.PermissionDenied, "untrusted proxy")
+		}
+	}
+	attrs := checkReq.GetAttributes()
+	httpReq := attrs.GetRequest().GetHttp()
+	headers := httpReq.GetHeaders()
+	var sessionID string
+	if cookie, err := (&http.Request{Header: http.Header{"Cookie": {headers["cookie"]}}}).Cookie(
+		config.Get().SessionStorage.CookieName,
+	); err == nil {
+		sessionID = cookie.Value
+	}
+	req := authRequest{
+		Host:          httpReq.GetHost(),
+		Path:          httpReq.GetPath(),
+		Method:        httpReq.GetMethod(),
+		Scheme:        httpReq.GetScheme(),
+		ClientIP:      attrs.GetSource().GetAddress().GetSocketAddress().GetAddress(),
+		SessionID:     sessionID,
+		BearerToken:   getBearerToken(headers["authorization"]),
+		Accept:        headers["accept"],
+		RequestedWith: headers["x-requested-with"],
+	}
+	return toCheckResponse(authorize(req), slices.Collect(maps.Keys(headers))), nil
+}
+
+func toHeaderValueOptions(headers map[string]string) []*corev3.HeaderValueOption {
+	options := make([]*corev3.HeaderValueOption, 0, len(headers))
+	for k, v := range headers {
+		options = append(
+			options, &corev3.HeaderValueOption{
+				Header: &corev3.HeaderValue{
+					Key:   k,
+					Value: v,
+				},
+				// Forwarded headers must not be spoofable by the client
+				AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+			},
+		)
+	}
+	return options
+}
+
+// toCheckResponse converts an authResponse into an ext_authz response;
+// headers of allowed requests are added to the upstream request and the
+// headers the rule could forward, but did not, are removed from the passed
+// request headers; denied requests are answered with the authResponse, e.g.
+// the login redirect
+func toCheckResponse(res authResponse, requestHeaders []string) *authv3.CheckResponse {
+	if res.Allowed() {
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{
+					Headers:         toHeaderValueOptions(res.Headers),
+					HeadersToRemove: headersToRemove(res, requestHeaders),
+				},
+			},
+		}
+	}
+	code := codes.PermissionDenied
+	if res.Status == fiber.StatusUnauthorized {
+		code = codes.Unauthenticated
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(res.Status)},
+				Headers: toHeaderValueOptions(res.Headers),
+				Body:    res.Body,
+			},
+		},
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/go-oidfed/lib"
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/grpc/codes"
+
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func TestHeadersToRemove(t *testing.T) {
+	withAssertion := &config.AuthRule{
+		ForwardHeaders:  map[string]oidfed.SliceOrSingleValue[model.Claim]{},
+		HeaderTemplates: map[string]string{"X-Name": "{{.name}}"},
+	}
+	withAssertion.Assertion.Enabled = true
+	withAssertion.Assertion.Header = "X-Offa-Assertion"
+	tests := []struct {
+		name           string
+		rule           *config.AuthRule
+		headers        map[string]string
+		requestHeaders []string
+		expected       []string
+	}{
+		{
+			name:    "default forward headers",
+			rule:    &config.AuthRule{},
+			headers: map[string]string{"X-Forwarded-Name": "Jane", "X-Forwarded-Subject": "jane"},
+			expected: []string{
+				"x-forwarded-email", "x-forwarded-groups", "x-forwarded-provider", "x-forwarded-user",
+			},
+		},
+		{
+			name: "set headers are not removed",
+			rule: &config.AuthRule{
+				ForwardHeaders: map[string]oidfed.SliceOrSingleValue[model.Claim]{
+					"X-User":  {"preferred_username"},
+					"X-Email": {"email"},
+				},
+			},
+			headers:  map[string]string{"X-User": "jane"},
+			expected: []string{"x-email"},
+		},
+		{
+			name: "prefix",
+			rule: &config.AuthRule{
+				ForwardHeaders:       map[string]oidfed.SliceOrSingleValue[model.Claim]{},
+				ForwardHeadersPrefix: "OIDC",
+			},
+			headers:        map[string]string{"OIDC-SUB": "jane"},
+			requestHeaders: []string{"oidc-sub", "oidc-email", "oidc", "x-other"},
+			expected:       []string{"oidc-email"},
+		},
+		{
+			name:           "mod_auth_openidc preset",
+			rule:           &config.AuthRule{ForwardHeadersPreset: config.ForwardHeadersPresetModAuthOpenIDC},
+			requestHeaders: []string{"OIDC_CLAIM_email", "Oidc-Claim-Email"},
+			expected:       []string{"oidc_claim_email"},
+		},
+		{
+			name:     "basic preset",
+			rule:     &config.AuthRule{ForwardHeadersPreset: config.ForwardHeadersPresetBasic},
+			expected: []string{"authorization"},
+		},
+		{
+			name:     "templates and assertion",
+			rule:     withAssertion,
+			expected: []string{"x-name", "x-offa-assertion"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				res := authResponse{
+					Status:  fiber.StatusOK,
+					Headers: test.headers,
+					Rule:    test.rule,
+				}
+				if remove := headersToRemove(res, test.requestHeaders); !slices.Equal(remove, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, remove)
+				}
+			},
+		)
+	}
+	denied := authResponse{
+		Status: fiber.StatusForbidden,
+		Rule:   &config.AuthRule{},
+	}
+	if remove := headersToRemove(denied, nil); remove != nil {
+		t.Errorf("expected no headers to remove for denied request, got %v", remove)
+	}
+}
+
+func TestExtAuthzGRPCCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		headers  map[string]string
+		code     codes.Code
+		status   int
+		toRemove []string
+	}{
+		{
+			name: "anonymous without session",
+			host: "public.example.com",
+			path: "/",
+			headers: map[string]string{
+				"x-forwarded-user": "admin",
+				"oidc-email":       "admin@example.com",
+				"x-other":          "value",
+			},
+			code:     codes.OK,
+			toRemove: []string{"oidc-email", "x-forwarded-user", "x-name", "x-offa-assertion"},
+		},
+		{
+			name:   "deny rule",
+			host:   "deny.example.com",
+			path:   "/admin",
+			code:   codes.PermissionDenied,
+			status: fiber.StatusForbidden,
+		},
+		{
+			name:   "deny rule with query",
+			host:   "deny.example.com",
+			path:   "/admin?x=1",
+			code:   codes.PermissionDenied,
+			status: fiber.StatusForbidden,
+		},
+		{
+			name:   "deny rule with port",
+			host:   "deny.example.com:8443",
+			path:   "/admin",
+			code:   codes.PermissionDenied,
+			status: fiber.StatusForbidden,
+		},
+		{
+			name:   "no matching rule",
+			host:   "other.example.com",
+			path:   "/",
+			code:   codes.PermissionDenied,
+			status: fiber.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				res, err := (&extAuthzServer{}).Check(
+					context.Background(), &authv3.CheckRequest{
+						Attributes: &authv3.AttributeContext{
+							Request: &authv3.AttributeContext_Request{
+								Http: &authv3.AttributeContext_HttpRequest{
+									Host:    test.host,
+									Path:    test.path,
+									Method:  "GET",
+									Scheme:  "https",
+									Headers: test.headers,
+								},
+							},
+						},
+					},
+				)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if code := codes.Code(res.GetStatus().GetCode()); code != test.code {
+					t.Fatalf("expected code %s, got %s", test.code, code)
+				}
+				if test.code != codes.OK {
+					if status := int(res.GetDeniedResponse().GetStatus().GetCode()); status != test.status {
+						t.Errorf("expected status %d, got %d", test.status, status)
+					}
+					return
+				}
+				if remove := res.GetOkResponse().GetHeadersToRemove(); !slices.Equal(remove, test.toRemove) {
+					t.Errorf("expected headers to remove %v, got %v", test.toRemove, remove)
+				}
+			},
+		)
+	}
+}
+
+func TestExtAuthzHTTP(t *testing.T) {
+	app := fiber.New()
+	addExtAuthzHandlers(app)
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		status   int
+		toRemove string
+	}{
+		{
+			name:     "anonymous without session",
+			host:     "public.example.com",
+			path:     "/page",
+			status:   fiber.StatusOK,
+			toRemove: "oidc-email, x-forwarded-user, x-name, x-offa-assertion",
+		},
+		{
+			name:   "deny rule",
+			host:   "deny.example.com",
+			path:   "/admin",
+			status: fiber.StatusForbidden,
+		},
+		{
+			name:   "deny rule with query",
+			host:   "deny.example.com",
+			path:   "/admin?x=1",
+			status: fiber.StatusForbidden,
+		},
+		{
+			name:   "default forward headers",
+			host:   "deny.example.com",
+			path:   "/public",
+			status: fiber.StatusOK,
+			toRemove: "x-forwarded-email, x-forwarded-groups, x-forwarded-name, x-forwarded-provider, " +
+				"x-forwarded-subject, x-forwarded-user",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", "/ext-authz"+test.path, nil)
+				req.Host = test.host
+				req.Header.Set("X-Forwarded-User", "admin")
+				req.Header.Set("OIDC-Email", "admin@example.com")
+				res, err := app.Test(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.StatusCode != test.status {
+					t.Fatalf("expected status %d, got %d", test.status, res.StatusCode)
+				}
+				remove := res.Header.Get(headerEnvoyAuthHeadersToRemove)
+				if test.status == fiber.StatusOK && remove != test.toRemove {
+					t.Errorf("expected headers to remove '%s', got '%s'", test.toRemove, remove)
+				}
+				if test.status != fiber.StatusOK && remove != "" {
+					t.Errorf("expected no headers to remove for denied request, got '%s'", remove)
+				}
+			},
+		)
+	}
+}
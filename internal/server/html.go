@@ -19,8 +19,10 @@ func initHtmls() {
 	serverConfig.Views = engine
 
 	paths = map[string]string{
-		"login": getFullPath(config.Get().Server.Paths.Login),
-		"auth":  getFullPath(config.Get().Server.Paths.ForwardAuth),
+		"login":   getFullPath(config.Get().Server.Paths.Login),
+		"logout":  getFullPath(config.Get().Server.Paths.Logout),
+		"auth":    getFullPath(config.Get().Server.Paths.ForwardAuth),
+		"ops_api": getFullPath(config.Get().Server.Paths.OPsAPI),
 	}
 }
 
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+const opKeysCacheLifetime = 10 * time.Minute
+
+// getOPKeys returns the signing keys of an OP. The keys are obtained from the
+// OP's metadata as resolved through the federation, either directly from
+// the jwks or from the jwks_uri.
+func getOPKeys(issuer string, forceRefresh bool) (jwks.JWKS, error) {
+	var set jwks.JWKS
+	if !forceRefresh {
+		found, err := cache.Get(cache.KeyOPJWKS, issuer, &set)
+		if err != nil {
+			log.WithError(err).Error("failed to obtain op jwks from cache")
+		}
+		if found && set.Set != nil {
+			return set, nil
+		}
+	}
+	opMetadata, err := federationLeafEntity.ResolveOPMetadata(issuer)
+	if err != nil {
+		return set, err
+	}
+	switch {
+	case opMetadata.JWKS != nil && opMetadata.JWKS.Set != nil && opMetadata.JWKS.Len() > 0:
+		set = *opMetadata.JWKS
+	case opMetadata.JWKSURI != "":
+		s, err := jwk.Fetch(context.Background(), opMetadata.JWKSURI)
+		if err != nil {
+			return set, errors.Wrap(err, "could not fetch op jwks")
+		}
+		set = jwks.JWKS{Set: s}
+	default:
+		return set, errors.New("op metadata does not contain any keys")
+	}
+	if err = cache.Set(cache.KeyOPJWKS, issuer, set, opKeysCacheLifetime); err != nil {
+		log.WithError(err).Error("failed to cache op jwks")
+	}
+	return set, nil
+}
+
+// opKeysRefreshInterval is the minimal interval between two forced
+// refreshes of an OP's keys, so that tokens with unknown key ids cannot be
+// used to make us fetch the OP's keys on every request
+const opKeysRefreshInterval = time.Minute
+
+var (
+	opKeysRefreshesMu sync.Mutex
+	opKeysRefreshes   = make(map[string]time.Time)
+)
+
+// mayRefreshOPKeys checks if the keys of the passed OP may be refreshed now
+// and if so records the refresh
+func mayRefreshOPKeys(issuer string) bool {
+	opKeysRefreshesMu.Lock()
+	defer opKeysRefreshesMu.Unlock()
+	now := time.Now()
+	if last, ok := opKeysRefreshes[issuer]; ok && now.Sub(last) < opKeysRefreshInterval {
+		return false
+	}
+	opKeysRefreshes[issuer] = now
+	return true
+}
+
+// verifyOPSignedJWT verifies the signature of a jwt issued by the passed OP
+// and returns the payload. If the token's kid is not in the cached keys, the
+// keys are refreshed once, since the OP might have rotated its keys; this
+// is done at most once per opKeysRefreshInterval for each OP.
+func verifyOPSignedJWT(token, issuer string) ([]byte, error) {
+	set, err := getOPKeys(issuer, false)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := jws.Verify([]byte(token), jws.WithKeySet(set.Set, jws.WithInferAlgorithmFromKey(true)))
+	if err == nil {
+		return payload, nil
+	}
+	kid := tokenKeyID(token)
+	if kid == "" {
+		return nil, errors.WithStack(err)
+	}
+	if _, known := set.LookupKeyID(kid); known || !mayRefreshOPKeys(issuer) {
+		return nil, errors.WithStack(err)
+	}
+	set, err = getOPKeys(issuer, true)
+	if err != nil {
+		return nil, err
+	}
+	payload, err = jws.Verify([]byte(token), jws.WithKeySet(set.Set, jws.WithInferAlgorithmFromKey(true)))
+	return payload, errors.WithStack(err)
+}
+
+// tokenKeyID returns the kid from the protected header of the passed jws or
+// an empty string if it has none
+func tokenKeyID(token string) string {
+	msg, err := jws.ParseString(token)
+	if err != nil || len(msg.Signatures()) == 0 {
+		return ""
+	}
+	kid, _ := msg.Signatures()[0].ProtectedHeaders().KeyID()
+	return kid
+}
+
+// tokenValidationError is returned if a token fails validation; the Reason
+// is used as the error on the error page
+type tokenValidationError struct {
+	Reason  string
+	Message string
+}
+
+// Error implements the error interface
+func (e tokenValidationError) Error() string {
+	if e.Message == "" {
+		return e.Reason
+	}
+	return e.Reason + ": " + e.Message
+}
+
+func newTokenValidationError(reason, message string) error {
+	return tokenValidationError{
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+func clockSkew() time.Duration {
+	return time.Duration(config.Get().Federation.ClockSkew) * time.Second
+}
+
+// checkTokenAudience checks that the token's aud claim contains our entity
+// id and if there are multiple audiences (or an azp is given) that azp is
+// our entity id
+func checkTokenAudience(tokenType string, claims model.UserClaims) error {
+	clientID := config.Get().Federation.EntityID
+	aud := claims.GetAudience()
+	if !slices.Contains(aud, clientID) {
+		return newTokenValidationError(
+			tokenType+" audience mismatch", "token was not issued for this client",
+		)
+	}
+	azp, azpSet := claims.GetString("azp")
+	if (len(aud) > 1 || azpSet) && azp != clientID {
+		return newTokenValidationError(
+			tokenType+" authorized party mismatch", "token was not issued for this client",
+		)
+	}
+	return nil
+}
+
+// checkTokenTimes checks the exp, iat, and nbf claims of a token taking the
+// configured clock skew into account
+func checkTokenTimes(tokenType string, claims model.UserClaims, expRequired bool) error {
+	now := time.Now()
+	skew := clockSkew()
+	exp, expSet := claims.GetTime("exp")
+	if !expSet && expRequired {
+		return newTokenValidationError(tokenType+" expired", "token does not contain an expiration time")
+	}
+	if expSet && now.Add(-skew).After(exp) {
+		return newTokenValidationError(tokenType+" expired", "token expired at "+exp.String())
+	}
+	if iat, ok := claims.GetTime("iat"); ok && now.Add(skew).Before(iat) {
+		return newTokenValidationError(tokenType+" issued in the future", "token issued at "+iat.String())
+	}
+	if nbf, ok := claims.GetTime("nbf"); ok && now.Add(skew).Before(nbf) {
+		return newTokenValidationError(tokenType+" not yet valid", "token not valid before "+nbf.String())
+	}
+	return nil
+}
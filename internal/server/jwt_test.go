@@ -0,0 +1,342 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jws"
+
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+// testOP signs tokens with a key that is put into the op jwks cache, so
+// that tokens can be verified without resolving the OP through a federation
+type testOP struct {
+	issuer string
+	key    *ecdsa.PrivateKey
+	kid    string
+}
+
+func newTestOP(t *testing.T, issuer string) *testOP {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := jwks.KeyToJWKS(&key.PublicKey, jwa.ES256())
+	pub, _ := set.Key(0)
+	kid, _ := pub.KeyID()
+	if err = cache.Set(cache.KeyOPJWKS, issuer, set, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return &testOP{
+		issuer: issuer,
+		key:    key,
+		kid:    kid,
+	}
+}
+
+func (op *testOP) sign(t *testing.T, typ string, claims map[string]any) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := jws.NewHeaders()
+	if op.kid != "" {
+		if err = headers.Set(jws.KeyIDKey, op.kid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if typ != "" {
+		if err = headers.Set(jws.TypeKey, typ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := jws.Sign(payload, jws.WithKey(jwa.ES256(), op.key, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(token)
+}
+
+// withClaims returns a copy of the base claims with the passed changes; a
+// nil value removes a claim
+func withClaims(base map[string]any, changes map[string]any) map[string]any {
+	claims := make(map[string]any, len(base))
+	for k, v := range base {
+		claims[k] = v
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestCheckTokenTimes(t *testing.T) {
+	now := time.Now()
+	// the test config uses the default clock skew of 60 seconds
+	unix := func(d time.Duration) float64 { return float64(now.Add(d).Unix()) }
+	tests := []struct {
+		name        string
+		claims      model.UserClaims
+		expRequired bool
+		reason      string
+	}{
+		{
+			name:   "valid",
+			claims: model.UserClaims{"exp": unix(time.Minute), "iat": unix(0), "nbf": unix(0)},
+		},
+		{
+			name:        "missing exp",
+			claims:      model.UserClaims{"iat": unix(0)},
+			expRequired: true,
+			reason:      "token expired",
+		},
+		{
+			name:   "missing optional exp",
+			claims: model.UserClaims{"iat": unix(0)},
+		},
+		{
+			name:   "expired within clock skew",
+			claims: model.UserClaims{"exp": unix(-30 * time.Second)},
+		},
+		{
+			name:   "expired",
+			claims: model.UserClaims{"exp": unix(-2 * time.Minute)},
+			reason: "token expired",
+		},
+		{
+			name:   "issued in the future within clock skew",
+			claims: model.UserClaims{"exp": unix(time.Hour), "iat": unix(30 * time.Second)},
+		},
+		{
+			name:   "issued in the future",
+			claims: model.UserClaims{"exp": unix(time.Hour), "iat": unix(2 * time.Minute)},
+			reason: "token issued in the future",
+		},
+		{
+			name:   "not yet valid",
+			claims: model.UserClaims{"exp": unix(time.Hour), "nbf": unix(2 * time.Minute)},
+			reason: "token not yet valid",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				err := checkTokenTimes("token", test.claims, test.expRequired)
+				assertTokenValidationReason(t, err, test.reason)
+			},
+		)
+	}
+}
+
+func assertTokenValidationReason(t *testing.T, err error, reason string) {
+	t.Helper()
+	if reason == "" {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+	tokenErr, ok := err.(tokenValidationError)
+	if !ok {
+		t.Fatalf("expected token validation error '%s', got %v", reason, err)
+	}
+	if tokenErr.Reason != reason {
+		t.Errorf("expected reason '%s', got '%s'", reason, tokenErr.Reason)
+	}
+}
+
+func TestCheckTokenAudience(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims model.UserClaims
+		reason string
+	}{
+		{
+			name:   "single audience",
+			claims: model.UserClaims{"aud": testEntityID},
+		},
+		{
+			name:   "audience list",
+			claims: model.UserClaims{"aud": []any{testEntityID}},
+		},
+		{
+			name:   "other audience",
+			claims: model.UserClaims{"aud": "https://other.example.com"},
+			reason: "token audience mismatch",
+		},
+		{
+			name:   "missing audience",
+			claims: model.UserClaims{},
+			reason: "token audience mismatch",
+		},
+		{
+			name:   "multiple audiences without azp",
+			claims: model.UserClaims{"aud": []any{testEntityID, "https://other.example.com"}},
+			reason: "token authorized party mismatch",
+		},
+		{
+			name: "multiple audiences with azp",
+			claims: model.UserClaims{
+				"aud": []any{testEntityID, "https://other.example.com"},
+				"azp": testEntityID,
+			},
+		},
+		{
+			name: "other azp",
+			claims: model.UserClaims{
+				"aud": testEntityID,
+				"azp": "https://other.example.com",
+			},
+			reason: "token authorized party mismatch",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				assertTokenValidationReason(t, checkTokenAudience("token", test.claims), test.reason)
+			},
+		)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	op := newTestOP(t, "https://op-id-token.example.org")
+	now := time.Now()
+	valid := map[string]any{
+		"iss":   op.issuer,
+		"sub":   "user",
+		"aud":   testEntityID,
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"nonce": "nonce",
+	}
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{
+			name:  "valid",
+			token: op.sign(t, "", valid),
+		},
+		{
+			name:   "missing",
+			reason: "missing id token",
+		},
+		{
+			name:   "not a jwt",
+			token:  "not-a-jwt",
+			reason: "error parsing id token",
+		},
+		{
+			name:   "issuer mismatch",
+			token:  op.sign(t, "", withClaims(valid, map[string]any{"iss": "https://other.example.org"})),
+			reason: "id token issuer mismatch",
+		},
+		{
+			name:   "audience mismatch",
+			token:  op.sign(t, "", withClaims(valid, map[string]any{"aud": "https://other.example.com"})),
+			reason: "id token audience mismatch",
+		},
+		{
+			name:   "expired",
+			token:  op.sign(t, "", withClaims(valid, map[string]any{"exp": now.Add(-time.Hour).Unix()})),
+			reason: "id token expired",
+		},
+		{
+			name:   "missing exp",
+			token:  op.sign(t, "", withClaims(valid, map[string]any{"exp": nil})),
+			reason: "id token expired",
+		},
+		{
+			name:   "issued in the future",
+			token:  op.sign(t, "", withClaims(valid, map[string]any{"iat": now.Add(time.Hour).Unix()})),
+			reason: "id token issued in the future",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				claims, err := verifyIDToken(test.token, op.issuer)
+				assertTokenValidationReason(t, err, test.reason)
+				if test.reason == "" {
+					if sub, _ := claims.GetString("sub"); sub != "user" {
+						t.Errorf("unexpected claims: %v", claims)
+					}
+				}
+			},
+		)
+	}
+}
+
+func TestMayRefreshOPKeys(t *testing.T) {
+	const issuer = "https://op-refresh-keys.example.org"
+	if !mayRefreshOPKeys(issuer) {
+		t.Fatal("expected first refresh to be allowed")
+	}
+	if mayRefreshOPKeys(issuer) {
+		t.Fatal("expected second refresh within the interval to be rejected")
+	}
+	opKeysRefreshesMu.Lock()
+	opKeysRefreshes[issuer] = time.Now().Add(-opKeysRefreshInterval)
+	opKeysRefreshesMu.Unlock()
+	if !mayRefreshOPKeys(issuer) {
+		t.Fatal("expected refresh after the interval to be allowed")
+	}
+}
+
+func TestVerifyOPSignedJWTInvalidSignature(t *testing.T) {
+	op := newTestOP(t, "https://op-invalid-signature.example.org")
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]any{"iss": op.issuer}
+	// The test OP cannot be resolved, so a refresh of its keys would fail;
+	// the cases therefore also check that no refresh is attempted
+	tests := []struct {
+		name   string
+		signer *testOP
+		before func()
+	}{
+		{
+			name:   "known kid",
+			signer: &testOP{issuer: op.issuer, key: otherKey, kid: op.kid},
+		},
+		{
+			name:   "no kid",
+			signer: &testOP{issuer: op.issuer, key: otherKey},
+		},
+		{
+			name:   "unknown kid within refresh interval",
+			signer: &testOP{issuer: op.issuer, key: otherKey, kid: "unknown"},
+			before: func() { mayRefreshOPKeys(op.issuer) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				if test.before != nil {
+					test.before()
+				}
+				if _, err := verifyOPSignedJWT(test.signer.sign(t, "", claims), op.issuer); err == nil {
+					t.Fatal("expected invalid signature to be rejected")
+				}
+			},
+		)
+	}
+}
@@ -2,25 +2,31 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/go-oidfed/lib"
-	"github.com/go-oidfed/lib/apimodel"
 	"github.com/go-oidfed/lib/oidfedconst"
 	"github.com/gofiber/fiber/v2"
 	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/go-oidfed/offa/internal"
 	"github.com/go-oidfed/offa/internal/cache"
 	"github.com/go-oidfed/offa/internal/config"
 	"github.com/go-oidfed/offa/internal/model"
+	"github.com/go-oidfed/offa/internal/opcatalog"
 	"github.com/go-oidfed/offa/internal/pkce"
 )
 
 const browserStateCookieName = "_offa_auth_state"
+const lastOPCookieName = "offa_last_op"
+
+// lastOPCookieLifetime is the lifetime of the cookie remembering the OP a
+// user last logged in with in seconds
+const lastOPCookieLifetime = 365 * 24 * 60 * 60
 
 type postLoginRequest struct {
 	Issuer        string `json:"iss" form:"iss" query:"iss"`
@@ -52,64 +58,6 @@ func addLoginHandlers(s fiber.Router) {
 	s.Get("/redirect", codeExchange)
 }
 
-type opOption struct {
-	EntityID    string
-	DisplayName string
-	KeyWords    string
-	LogoURI     string
-}
-
-var opOptions []opOption
-
-func scheduleBuildOPOptions() {
-	ticker := time.NewTicker(time.Duration(config.Get().Federation.EntityCollectionInterval) * time.Minute) // Replace 5 with your desired interval
-
-	go buildOPOptions()
-
-	go func() {
-		for range ticker.C {
-			buildOPOptions()
-		}
-	}()
-}
-
-func buildOPOptions() {
-	filters := []oidfed.EntityCollectionFilter{}
-	allOPs := make(map[string]*oidfed.CollectedEntity)
-	var options []opOption
-	for _, ta := range config.Get().Federation.TrustAnchors {
-		var collector oidfed.EntityCollector
-		if config.Get().Federation.UseEntityCollectionEndpoint {
-			collector = oidfed.SmartRemoteEntityCollector{TrustAnchors: config.Get().Federation.TrustAnchors.EntityIDs()}
-		} else {
-			collector = &oidfed.SimpleEntityCollector{}
-		}
-		ops := oidfed.FilterableVerifiedChainsEntityCollector{
-			Collector: collector,
-			Filters:   filters,
-		}.CollectEntities(
-			apimodel.EntityCollectionRequest{
-				TrustAnchor: ta.EntityID,
-				EntityTypes: []string{oidfedconst.EntityTypeOpenIDProvider},
-			},
-		)
-		for _, op := range ops {
-			allOPs[op.EntityID] = op
-		}
-	}
-	for _, op := range allOPs {
-		options = append(
-			options, opOption{
-				EntityID:    op.EntityID,
-				DisplayName: getDisplayNameFromEntityInfo(op),
-				LogoURI:     getLogoURIFromEntityInfo(op),
-				KeyWords:    strings.Join(getKeywordsFromEntityInfo(op), " "),
-			},
-		)
-	}
-	opOptions = options
-}
-
 func getDisplayNameFromEntityInfo(entity *oidfed.CollectedEntity) string {
 	if entity == nil {
 		return ""
@@ -158,13 +106,81 @@ func getLogoURIFromEntityInfo(entity *oidfed.CollectedEntity) string {
 	return ""
 }
 
+func getInformationURIFromEntityInfo(entity *oidfed.CollectedEntity) string {
+	if entity == nil || entity.UIInfos == nil {
+		return ""
+	}
+	op, ok := entity.UIInfos[oidfedconst.EntityTypeOpenIDProvider]
+	if ok && op.InformationURI != "" {
+		return op.InformationURI
+	}
+	fed, ok := entity.UIInfos[oidfedconst.EntityTypeFederationEntity]
+	if ok && fed.InformationURI != "" {
+		return fed.InformationURI
+	}
+	return ""
+}
+
 func showLoginPage(c *fiber.Ctx) error {
+	next := c.Query("next")
+	restriction := opRestrictionFromQuery(c)
+	ops := restriction.filterOPs(opCatalog.OPs())
+	// If only a single OP can be used, there is nothing to choose
+	switch {
+	case len(ops) == 1:
+		return doLogin(c, ops[0].EntityID, next, c.Query("login_hint"))
+	case len(ops) == 0 && len(restriction.Issuers) == 1:
+		// The OP is not offered on the login page (e.g. because of the op
+		// filters), but the auth rule only allows this OP; the other
+		// restrictions of the rule are checked after the login
+		return doLogin(c, restriction.Issuers[0], next, c.Query("login_hint"))
+	}
 	return render(
 		c, "login", map[string]interface{}{
 			"client_name": config.Get().Federation.ClientName,
 			"logo_uri":    config.Get().Federation.LogoURI,
-			"ops":         opOptions,
-			"next":        c.Query("next"),
+			"ops":         ops,
+			"last_op":     getLastOP(c, ops),
+			"next":        next,
+		},
+	)
+}
+
+// getLastOPID returns the entity id of the OP the user last logged in with
+// or an empty string if it is not known
+func getLastOPID(c *fiber.Ctx) string {
+	entityID, ok := internal.VerifySigned(c.Cookies(lastOPCookieName))
+	if !ok {
+		return ""
+	}
+	return entityID
+}
+
+// getLastOP returns the OP the user last logged in with if it is one of the
+// passed OPs
+func getLastOP(c *fiber.Ctx, ops []opcatalog.OP) *opcatalog.OP {
+	entityID := getLastOPID(c)
+	if entityID == "" {
+		return nil
+	}
+	for _, op := range ops {
+		if op.EntityID == entityID {
+			return &op
+		}
+	}
+	return nil
+}
+
+func setLastOPCookie(c *fiber.Ctx, opID string) {
+	c.Cookie(
+		&fiber.Cookie{
+			Name:     lastOPCookieName,
+			Value:    internal.Sign(opID),
+			Path:     getFullPath("/"),
+			MaxAge:   lastOPCookieLifetime,
+			HTTPOnly: true,
+			Secure:   config.Get().Server.Secure,
+			SameSite: "lax",
 		},
 	)
 }
@@ -174,6 +190,7 @@ type stateData struct {
 	Issuer        string
 	BrowserState  string
 	Next          string
+	Nonce         string
 }
 
 func doLogin(c *fiber.Ctx, opID, next, loginHint string) error {
@@ -194,6 +211,7 @@ func doLogin(c *fiber.Ctx, opID, next, loginHint string) error {
 			Issuer:        opID,
 			BrowserState:  browserState,
 			Next:          next,
+			Nonce:         nonce,
 		}, 5*time.Minute,
 	); err != nil {
 		c.Status(fiber.StatusInternalServerError)
@@ -271,48 +289,96 @@ func codeExchange(c *fiber.Ctx) error {
 		return renderError(c, errRes.Error, errRes.ErrorDescription)
 	}
 
-	msg, err := jws.ParseString(tokenRes.IDToken)
+	idTokenData, err := verifyIDToken(tokenRes.IDToken, stateInfo.Issuer)
+	if err == nil {
+		if nonce, _ := idTokenData.GetString("nonce"); nonce != stateInfo.Nonce {
+			err = newTokenValidationError("id token nonce mismatch", "nonce does not match the login request")
+		}
+	}
 	if err != nil {
 		c.Status(444)
-		return renderError(c, "error parsing id token", err.Error())
+		var tErr tokenValidationError
+		if errors.As(err, &tErr) {
+			return renderError(c, tErr.Reason, tErr.Message)
+		}
+		return renderError(c, "error verifying id token", err.Error())
 	}
 	c.ClearCookie(browserStateCookieName)
 	if err = cache.Set(cache.KeyStateData, state, nil, time.Nanosecond); err != nil {
 		log.WithError(err).Error("failed to clear state cache")
 	}
-	var idTokenData model.UserClaims
-	err = json.Unmarshal(msg.Payload(), &idTokenData)
-	if err != nil {
+	if err = addUserinfoClaims(idTokenData, stateInfo.Issuer, tokenRes.AccessToken); err != nil {
 		c.Status(444)
-		c.Set(fiber.HeaderContentType, fiber.MIMETextHTML)
-		return renderError(c, "error decoding id token", err.Error())
+		var tErr tokenValidationError
+		if errors.As(err, &tErr) {
+			return renderError(c, tErr.Reason, tErr.Message)
+		}
+		return renderError(c, "error obtaining userinfo", err.Error())
 	}
 	log.Debugf("Userclaims are: %+v", idTokenData)
-	//TODO userinfo endpoint
 
 	sessionID, err := internal.RandomString(128)
 	if err != nil {
 		c.Status(fiber.StatusInternalServerError)
 		return renderError(c, "internal server error", err.Error())
 	}
-	if err = cache.SetSession(sessionID, idTokenData); err != nil {
+	now := time.Now()
+	session := model.Session{
+		Claims:        idTokenData,
+		IDToken:       tokenRes.IDToken,
+		LastValidated: now,
+		LoginTime:     now,
+	}
+	session.ExpiresAt = sessionExpiresAt(session)
+	if config.Get().SessionStorage.RefreshTokens && tokenRes.RefreshToken != "" {
+		session.EncryptedRefreshToken, err = internal.Encrypt(tokenRes.RefreshToken)
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return renderError(c, "internal server error", err.Error())
+		}
+	}
+	if err = cache.SetSession(sessionID, session); err != nil {
 		c.Status(fiber.StatusInternalServerError)
 		return renderError(c, "internal server error", err.Error())
 	}
 
-	c.Cookie(
-		&fiber.Cookie{
-			Name:     config.Get().SessionStorage.CookieName,
-			Value:    sessionID,
-			Domain:   config.Get().SessionStorage.CookieDomain,
-			MaxAge:   config.Get().SessionStorage.TTL,
-			HTTPOnly: true,
-			Secure:   config.Get().Server.Secure,
-			SameSite: "none",
-		},
-	)
+	setSessionCookie(c, sessionID, session)
+	setLastOPCookie(c, stateInfo.Issuer)
 	if stateInfo.Next == "" {
 		stateInfo.Next = "/"
 	}
 	return c.Redirect(stateInfo.Next)
 }
+
+// verifyIDToken verifies the signature of the id token with the keys of the
+// OP and validates the claims of the id token. The nonce is checked by the
+// caller.
+func verifyIDToken(idToken, issuer string) (model.UserClaims, error) {
+	const tokenType = "id token"
+	if idToken == "" {
+		return nil, newTokenValidationError("missing id token", "token response did not contain an id token")
+	}
+	if _, err := jws.ParseString(idToken); err != nil {
+		return nil, newTokenValidationError("error parsing id token", err.Error())
+	}
+	payload, err := verifyOPSignedJWT(idToken, issuer)
+	if err != nil {
+		return nil, newTokenValidationError("invalid id token signature", err.Error())
+	}
+	var claims model.UserClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, newTokenValidationError("error decoding id token", err.Error())
+	}
+	if iss, _ := claims.GetString("iss"); iss != issuer {
+		return nil, newTokenValidationError(
+			"id token issuer mismatch", fmt.Sprintf("expected '%s', got '%s'", issuer, iss),
+		)
+	}
+	if err = checkTokenAudience(tokenType, claims); err != nil {
+		return nil, err
+	}
+	if err = checkTokenTimes(tokenType, claims, true); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/go-oidfed/lib"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+
+	"github.com/go-oidfed/offa/internal"
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func addLogoutHandlers(s fiber.Router) {
+	path := config.Get().Server.Paths.Logout
+	s.Get(path, handleLogout)
+	s.Post(path, handleLogout)
+	s.Post(config.Get().Server.Paths.BackchannelLogout, handleBackchannelLogout)
+}
+
+func handleLogout(c *fiber.Ctx) error {
+	// If the OP redirects back to us after logout, the state is used to
+	// look up where the user should land
+	if state := c.Query("state"); state != "" {
+		var next string
+		found, err := cache.Get(cache.KeyLogout, state, &next)
+		if err != nil {
+			log.WithError(err).Error("failed to obtain logout state from cache")
+		}
+		if found {
+			if err = cache.Set(cache.KeyLogout, state, nil, time.Nanosecond); err != nil {
+				log.WithError(err).Error("failed to clear logout state cache")
+			}
+			return c.Redirect(next, fiber.StatusSeeOther)
+		}
+	}
+
+	next := internal.FirstNonEmpty(c.Query("next"), c.FormValue("next"))
+	if !isAllowedRedirectTarget(next) {
+		if next != "" {
+			log.WithField("next", next).Info("Ignoring logout redirect target not matching any auth rule")
+		}
+		next = fullLoginPath
+	}
+
+	var session model.Session
+	var found bool
+	if sessionID := c.Cookies(config.Get().SessionStorage.CookieName); sessionID != "" {
+		var err error
+		found, err = cache.GetSession(sessionID, &session)
+		if err != nil {
+			log.WithError(err).Error("failed to obtain session from cache")
+		}
+		if err = cache.DeleteSession(sessionID); err != nil {
+			log.WithError(err).Error("failed to delete session")
+		}
+		if found {
+			if err = cache.UnindexSession(sessionID, session.Claims); err != nil {
+				log.WithError(err).Error("failed to remove session from session index")
+			}
+		}
+	}
+	clearSessionCookie(c)
+
+	if found && session.IDToken != "" {
+		iss, _ := session.Claims.GetString("iss")
+		endSessionURL, err := getEndSessionURL(iss, session.IDToken, next)
+		if err != nil {
+			log.WithError(err).Error("failed to build end session url")
+		}
+		if endSessionURL != "" {
+			return c.Redirect(endSessionURL, fiber.StatusSeeOther)
+		}
+	}
+	return c.Redirect(next, fiber.StatusSeeOther)
+}
+
+func clearSessionCookie(c *fiber.Ctx) {
+	c.Cookie(
+		&fiber.Cookie{
+			Name:     config.Get().SessionStorage.CookieName,
+			Domain:   config.Get().SessionStorage.CookieDomain,
+			Expires:  fasthttp.CookieExpireDelete,
+			HTTPOnly: true,
+			Secure:   config.Get().Server.Secure,
+			SameSite: "none",
+		},
+	)
+}
+
+// getEndSessionURL returns the url of the OP's end_session_endpoint
+// including all parameters for the RP-initiated logout. If the OP does not
+// have an end_session_endpoint an empty string is returned.
+func getEndSessionURL(issuer, idToken, next string) (string, error) {
+	opMetadata, err := federationLeafEntity.ResolveOPMetadata(issuer)
+	if err != nil {
+		return "", err
+	}
+	if opMetadata.EndSessionEndpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(opMetadata.EndSessionEndpoint)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	state, err := internal.RandomString(64)
+	if err != nil {
+		return "", err
+	}
+	if err = cache.Set(cache.KeyLogout, state, next, 10*time.Minute); err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("id_token_hint", idToken)
+	q.Set("client_id", config.Get().Federation.EntityID)
+	q.Set("post_logout_redirect_uri", fullLogoutPath)
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// isAllowedRedirectTarget checks that the passed url is an absolute http(s)
+// url pointing to a domain that is protected by one of the configured auth
+// rules
+func isAllowedRedirectTarget(target string) bool {
+	if target == "" {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return false
+	}
+	return config.Get().Auth.MatchesDomain(u.Hostname())
+}
+
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+func handleBackchannelLogout(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	claims, err := verifyLogoutToken(c.FormValue("logout_token"))
+	if err != nil {
+		log.WithError(err).Info("Received invalid logout token")
+		return c.Status(fiber.StatusBadRequest).JSON(oidfed.ErrorInvalidRequest(err.Error()))
+	}
+	iss, _ := claims.GetString("iss")
+	sub, _ := claims.GetString("sub")
+	sid, _ := claims.GetString("sid")
+	n, err := cache.RevokeSessions(iss, sub, sid)
+	if err != nil {
+		log.WithError(err).Error("failed to revoke sessions")
+		return c.Status(fiber.StatusInternalServerError).JSON(oidfed.ErrorServerError(err.Error()))
+	}
+	log.WithFields(
+		log.Fields{
+			"iss":      iss,
+			"sub":      sub,
+			"sid":      sid,
+			"sessions": n,
+		},
+	).Info("Back-channel logout")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// verifyLogoutToken verifies a back-channel logout token according to
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation
+// The signature is verified with the keys of the issuing OP as resolved
+// through the federation.
+func verifyLogoutToken(token string) (model.UserClaims, error) {
+	const tokenType = "logout token"
+	if token == "" {
+		return nil, newTokenValidationError("missing logout token", "")
+	}
+	msg, err := jws.ParseString(token)
+	if err != nil {
+		return nil, newTokenValidationError("error parsing logout token", err.Error())
+	}
+	var unverifiedClaims model.UserClaims
+	if err = json.Unmarshal(msg.Payload(), &unverifiedClaims); err != nil {
+		return nil, newTokenValidationError("error decoding logout token", err.Error())
+	}
+	iss, _ := unverifiedClaims.GetString("iss")
+	if iss == "" {
+		return nil, newTokenValidationError("invalid logout token", "missing iss claim")
+	}
+	payload, err := verifyOPSignedJWT(token, iss)
+	if err != nil {
+		return nil, newTokenValidationError("invalid logout token signature", err.Error())
+	}
+	var claims model.UserClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, newTokenValidationError("error decoding logout token", err.Error())
+	}
+	if err = checkTokenAudience(tokenType, claims); err != nil {
+		return nil, err
+	}
+	if err = checkTokenTimes(tokenType, claims, true); err != nil {
+		return nil, err
+	}
+	events, _ := claims["events"].(map[string]any)
+	if _, ok := events[backchannelLogoutEvent]; !ok {
+		return nil, newTokenValidationError("invalid logout token", "missing back-channel logout event")
+	}
+	sub, _ := claims.GetString("sub")
+	sid, _ := claims.GetString("sid")
+	if sub == "" && sid == "" {
+		return nil, newTokenValidationError("invalid logout token", "neither sub nor sid claim present")
+	}
+	if _, ok := claims["nonce"]; ok {
+		return nil, newTokenValidationError("invalid logout token", "nonce claim must not be present")
+	}
+	jti, _ := claims.GetString("jti")
+	if jti == "" {
+		return nil, newTokenValidationError("invalid logout token", "missing jti claim")
+	}
+	var seen bool
+	jtiKey := cache.SessionIndexKey(iss, jti)
+	if _, err = cache.Get(cache.KeyLogoutTokenJTI, jtiKey, &seen); err != nil {
+		return nil, err
+	}
+	if seen {
+		return nil, newTokenValidationError("invalid logout token", "logout token was already used")
+	}
+	exp, _ := claims.GetTime("exp")
+	if err = cache.Set(cache.KeyLogoutTokenJTI, jtiKey, true, time.Until(exp)+clockSkew()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
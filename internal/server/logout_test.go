@@ -0,0 +1,114 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyLogoutToken(t *testing.T) {
+	op := newTestOP(t, "https://op-logout.example.org")
+	now := time.Now()
+	valid := func(jti string) map[string]any {
+		return map[string]any{
+			"iss": op.issuer,
+			"sub": "user",
+			"sid": "session",
+			"aud": testEntityID,
+			"iat": now.Unix(),
+			"exp": now.Add(time.Minute).Unix(),
+			"jti": jti,
+			"events": map[string]any{
+				backchannelLogoutEvent: map[string]any{},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		message string
+	}{
+		{
+			name:   "valid",
+			claims: valid("valid"),
+		},
+		{
+			name:   "only sid",
+			claims: withClaims(valid("only-sid"), map[string]any{"sub": nil}),
+		},
+		{
+			name:    "missing events",
+			claims:  withClaims(valid("missing-events"), map[string]any{"events": nil}),
+			message: "missing back-channel logout event",
+		},
+		{
+			name: "other event",
+			claims: withClaims(
+				valid("other-event"),
+				map[string]any{"events": map[string]any{"https://example.org/event": map[string]any{}}},
+			),
+			message: "missing back-channel logout event",
+		},
+		{
+			name:    "nonce present",
+			claims:  withClaims(valid("nonce"), map[string]any{"nonce": "n"}),
+			message: "nonce claim must not be present",
+		},
+		{
+			name:    "neither sub nor sid",
+			claims:  withClaims(valid("no-sub-sid"), map[string]any{"sub": nil, "sid": nil}),
+			message: "neither sub nor sid claim present",
+		},
+		{
+			name:    "missing jti",
+			claims:  withClaims(valid(""), map[string]any{"jti": nil}),
+			message: "missing jti claim",
+		},
+		{
+			name:    "other audience",
+			claims:  withClaims(valid("other-aud"), map[string]any{"aud": "https://other.example.com"}),
+			message: "token was not issued for this client",
+		},
+		{
+			name:    "missing exp",
+			claims:  withClaims(valid("missing-exp"), map[string]any{"exp": nil}),
+			message: "token does not contain an expiration time",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				_, err := verifyLogoutToken(op.sign(t, "logout+jwt", test.claims))
+				if test.message == "" {
+					if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					return
+				}
+				assertTokenValidationError(t, err, test.message)
+			},
+		)
+	}
+}
+
+func TestVerifyLogoutTokenReplay(t *testing.T) {
+	op := newTestOP(t, "https://op-logout-replay.example.org")
+	now := time.Now()
+	token := op.sign(
+		t, "logout+jwt", map[string]any{
+			"iss": op.issuer,
+			"sub": "user",
+			"aud": testEntityID,
+			"iat": now.Unix(),
+			"exp": now.Add(time.Minute).Unix(),
+			"jti": "replayed",
+			"events": map[string]any{
+				backchannelLogoutEvent: map[string]any{},
+			},
+		},
+	)
+	if _, err := verifyLogoutToken(token); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := verifyLogoutToken(token)
+	assertTokenValidationError(t, err, "logout token was already used")
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-oidfed/offa/internal/config"
+)
+
+const testEntityID = "https://offa.example.com"
+
+// testConfig is the configuration used by the tests; the auth rules are
+// used by the tests that go through authorize
+const testConfig = `
+federation:
+  entity_id: %s
+  key_storage: %s
+auth:
+  - domain: public.example.com
+    anonymous: true
+    forward_headers:
+      X-Forwarded-User: preferred_username
+    forward_headers_prefix: OIDC
+    forward_header_templates:
+      X-Name: "{{.name}}"
+    assertion:
+      enabled: true
+  - domain: deny.example.com
+    path: /admin
+    action: deny
+  - domain: deny.example.com
+    anonymous: true
+  - domain: anonymous.example.com
+    anonymous: true
+    bearer:
+      enabled: true
+    allowed_issuers:
+      - https://op-allowed.example.org
+    require:
+      groups: staff
+    forward_headers:
+      X-Forwarded-User: preferred_username
+  - domain: app.example.com
+    redirect_status: 302
+    require:
+      groups: staff
+  - domain: api.example.com
+    api: true
+    require:
+      groups: staff
+`
+
+// TestMain loads a minimal configuration, since most of the server package
+// reads the global config
+func TestMain(m *testing.M) {
+	os.Exit(runWithTestConfig(m))
+}
+
+func runWithTestConfig(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "offa-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	data := fmt.Sprintf(testConfig, testEntityID, dir)
+	if err = os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(data), 0600); err != nil {
+		panic(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	config.MustLoadConfig()
+	if err = os.Chdir(wd); err != nil {
+		panic(err)
+	}
+	return m.Run()
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-oidfed/lib"
+	"github.com/go-oidfed/lib/apimodel"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/opcatalog"
+)
+
+var opCatalog *opcatalog.Catalog
+
+// initOPCatalog creates the opcatalog.Catalog from the persisted catalog
+// and schedules the entity collection
+func initOPCatalog() {
+	fedConf := config.Get().Federation
+	opCatalog = opcatalog.New(collectOPs, fedConf.TrustAnchors.EntityIDs(), fedConf.OPCatalogFile)
+	opCatalog.Schedule(time.Duration(fedConf.EntityCollectionInterval) * time.Minute)
+}
+
+// collectOPs collects the OPs below a trust anchor and applies the
+// configured op filters. The collection fails if the trust anchor cannot be
+// reached; a trust anchor without OPs results in an empty list.
+func collectOPs(trustAnchor string) ([]opcatalog.OP, error) {
+	if _, err := oidfed.GetEntityConfiguration(trustAnchor); err != nil {
+		return nil, errors.Wrap(err, "could not obtain trust anchor entity configuration")
+	}
+	var collector oidfed.EntityCollector
+	if config.Get().Federation.UseEntityCollectionEndpoint {
+		collector = oidfed.SmartRemoteEntityCollector{TrustAnchors: config.Get().Federation.TrustAnchors.EntityIDs()}
+	} else {
+		collector = &oidfed.SimpleEntityCollector{}
+	}
+	entities := collector.CollectEntities(
+		apimodel.EntityCollectionRequest{
+			TrustAnchor: trustAnchor,
+			EntityTypes: []string{oidfedconst.EntityTypeOpenIDProvider},
+		},
+	)
+	filters := append(
+		[]oidfed.EntityCollectionFilter{
+			oidfed.EntityCollectionFilterVerifiedChains{
+				TrustAnchors: oidfed.NewTrustAnchorsFromEntityIDs(trustAnchor),
+			},
+		}, opCollectionFilters()...,
+	)
+	var ops []opcatalog.OP
+	for _, e := range entities {
+		if !passesFilters(e, filters) {
+			continue
+		}
+		op := opcatalog.OP{
+			EntityID:       e.EntityID,
+			DisplayName:    getDisplayNameFromEntityInfo(e),
+			LogoURI:        getLogoURIFromEntityInfo(e),
+			KeyWords:       strings.Join(getKeywordsFromEntityInfo(e), " "),
+			InformationURI: getInformationURIFromEntityInfo(e),
+		}
+		addEntityConfigurationInfo(&op)
+		chains, err := getOPTrustChains(e.EntityID)
+		if err != nil {
+			log.WithError(err).WithField("op", e.EntityID).Info("Could not resolve trust chains of OP")
+		}
+		op.TrustChains = chains
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// addEntityConfigurationInfo adds the information from the OP's entity
+// configuration that is not part of the collected entity; the entity
+// configuration was already fetched (and cached) to verify the trust chain
+func addEntityConfigurationInfo(op *opcatalog.OP) {
+	stmt, err := oidfed.GetEntityConfiguration(op.EntityID)
+	if err != nil || stmt.Metadata == nil {
+		return
+	}
+	add := func(organizationName, informationURI string, extra map[string]any) {
+		op.OrganizationName = internal.FirstNonEmpty(op.OrganizationName, organizationName)
+		op.InformationURI = internal.FirstNonEmpty(op.InformationURI, informationURI)
+		for k, v := range extra {
+			lang, ok := strings.CutPrefix(k, "display_name#")
+			name, isString := v.(string)
+			if !ok || !isString || name == "" {
+				continue
+			}
+			if op.DisplayNames == nil {
+				op.DisplayNames = make(map[string]string)
+			}
+			if _, set := op.DisplayNames[lang]; !set {
+				op.DisplayNames[lang] = name
+			}
+		}
+	}
+	if m := stmt.Metadata.OpenIDProvider; m != nil {
+		add(m.OrganizationName, m.InformationURI, m.Extra)
+	}
+	if m := stmt.Metadata.FederationEntity; m != nil {
+		add(m.OrganizationName, m.InformationURI, m.Extra)
+	}
+}
+
+func passesFilters(e *oidfed.CollectedEntity, filters []oidfed.EntityCollectionFilter) bool {
+	for _, f := range filters {
+		if !f.Filter(e) {
+			return false
+		}
+	}
+	return true
+}
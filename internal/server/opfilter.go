@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/go-oidfed/lib"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal/config"
+)
+
+// opCollectionFilters returns the filters for the collected OPs that are
+// configured in the federation.op_filters option. Cheap filters come first,
+// so that metadata and trust chains are only resolved if needed.
+func opCollectionFilters() []oidfed.EntityCollectionFilter {
+	fedConf := config.Get().Federation
+	conf := fedConf.OPFilters
+	trustAnchorIDs := fedConf.TrustAnchors.EntityIDs()
+
+	filters := []oidfed.EntityCollectionFilter{
+		oidfed.NewEntityCollectionFilter(
+			func(e *oidfed.CollectedEntity) bool {
+				return e != nil && conf.Allows(e.EntityID)
+			},
+		),
+	}
+	if fedConf.OnlyAutomaticOPs {
+		filters = append(filters, oidfed.EntityCollectionFilterOPSupportsAutomaticRegistration(trustAnchorIDs))
+	}
+	if len(conf.SupportedScopes) > 0 {
+		filters = append(
+			filters, oidfed.EntityCollectionFilterOPSupportedScopesIncludes(trustAnchorIDs, conf.SupportedScopes...),
+		)
+	}
+	if len(conf.SupportedClaims) > 0 {
+		filters = append(filters, entityCollectionFilterOPSupportedClaimsIncludes(conf.SupportedClaims))
+	}
+	if len(conf.Intermediates) > 0 || len(conf.RequiredTrustMarks) > 0 {
+		restriction := opRestriction{
+			TrustAnchors: conf.Intermediates,
+			TrustMarks:   conf.RequiredTrustMarks,
+		}
+		filters = append(
+			filters, oidfed.NewEntityCollectionFilter(
+				func(e *oidfed.CollectedEntity) bool {
+					return e != nil && restriction.allows(e.EntityID)
+				},
+			),
+		)
+	}
+	return filters
+}
+
+// entityCollectionFilterOPSupportedClaimsIncludes returns an
+// oidfed.EntityCollectionFilter that filters to OPs that support the passed
+// claims
+func entityCollectionFilterOPSupportedClaimsIncludes(claims []string) oidfed.EntityCollectionFilter {
+	return oidfed.NewEntityCollectionFilter(
+		func(e *oidfed.CollectedEntity) bool {
+			if e == nil {
+				return false
+			}
+			opMetadata, err := federationLeafEntity.ResolveOPMetadata(e.EntityID)
+			if err != nil {
+				log.WithError(err).WithField("op", e.EntityID).Debug("Could not resolve op metadata")
+				return false
+			}
+			return config.IsSubset(claims, opMetadata.ClaimsSupported)
+		},
+	)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/go-oidfed/lib"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/opcatalog"
+)
+
+// Query parameters used to pass the OP restriction of an AuthRule to the
+// login page
+const (
+	queryAllowedIssuer      = "allowed_issuer"
+	queryAllowedTrustAnchor = "allowed_trust_anchor"
+	queryRequiredTrustMark  = "required_trust_mark"
+)
+
+const opTrustChainsCacheLifetime = 10 * time.Minute
+
+// opRestriction restricts the OPs that are accepted
+type opRestriction struct {
+	Issuers      []string
+	TrustAnchors []string
+	TrustMarks   []string
+}
+
+func ruleOPRestriction(rule *config.AuthRule) opRestriction {
+	if rule == nil {
+		return opRestriction{}
+	}
+	return opRestriction{
+		Issuers:      rule.AllowedIssuers,
+		TrustAnchors: rule.AllowedTrustAnchors,
+		TrustMarks:   rule.RequiredOPTrustMarks,
+	}
+}
+
+// opRestrictionFromQuery returns the opRestriction passed to the login page
+func opRestrictionFromQuery(c *fiber.Ctx) opRestriction {
+	values := func(key string) (vs []string) {
+		for _, v := range c.Context().QueryArgs().PeekMulti(key) {
+			vs = append(vs, string(v))
+		}
+		return
+	}
+	return opRestriction{
+		Issuers:      values(queryAllowedIssuer),
+		TrustAnchors: values(queryAllowedTrustAnchor),
+		TrustMarks:   values(queryRequiredTrustMark),
+	}
+}
+
+func (r opRestriction) empty() bool {
+	return len(r.Issuers) == 0 && len(r.TrustAnchors) == 0 && len(r.TrustMarks) == 0
+}
+
+// addToQuery adds the opRestriction to the passed query parameters
+func (r opRestriction) addToQuery(q url.Values) {
+	for _, v := range r.Issuers {
+		q.Add(queryAllowedIssuer, v)
+	}
+	for _, v := range r.TrustAnchors {
+		q.Add(queryAllowedTrustAnchor, v)
+	}
+	for _, v := range r.TrustMarks {
+		q.Add(queryRequiredTrustMark, v)
+	}
+}
+
+// allows checks if the OP with the passed issuer fulfills the opRestriction.
+// The trust chains of the OP are resolved if needed; this must only be used
+// for OPs a user already authenticated with, e.g. the issuer of a session.
+func (r opRestriction) allows(issuer string) bool {
+	if r.empty() {
+		return true
+	}
+	if issuer == "" {
+		return false
+	}
+	if len(r.Issuers) > 0 && !slices.Contains(r.Issuers, issuer) {
+		return false
+	}
+	if len(r.TrustAnchors) == 0 && len(r.TrustMarks) == 0 {
+		return true
+	}
+	chains, err := getOPTrustChains(issuer)
+	if err != nil {
+		log.WithError(err).WithField("iss", issuer).Info("Could not resolve trust chains of OP")
+		return false
+	}
+	return r.allowsChains(chains)
+}
+
+// allowsOP checks if a collected OP fulfills the opRestriction. Only the
+// trust chains stored in the catalog are used, so that nothing is resolved
+// for the (user controlled) restriction of the login page and the ops api.
+func (r opRestriction) allowsOP(op opcatalog.OP) bool {
+	if len(r.Issuers) > 0 && !slices.Contains(r.Issuers, op.EntityID) {
+		return false
+	}
+	if len(r.TrustAnchors) == 0 && len(r.TrustMarks) == 0 {
+		return true
+	}
+	return r.allowsChains(op.TrustChains)
+}
+
+// allowsChains checks if at least one of the trust chains contains an
+// allowed trust anchor or intermediate and all required trust marks are
+// valid within that chain
+func (r opRestriction) allowsChains(chains []opcatalog.TrustChain) bool {
+	for _, chain := range chains {
+		if len(r.TrustAnchors) > 0 && !slices.ContainsFunc(
+			chain.Entities, func(e string) bool {
+				return slices.Contains(r.TrustAnchors, e)
+			},
+		) {
+			continue
+		}
+		if config.IsSubset(r.TrustMarks, chain.TrustMarks) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterOPs returns the OPs that fulfill the opRestriction
+func (r opRestriction) filterOPs(ops []opcatalog.OP) []opcatalog.OP {
+	if r.empty() {
+		return ops
+	}
+	var filtered []opcatalog.OP
+	for _, op := range ops {
+		if r.allowsOP(op) {
+			filtered = append(filtered, op)
+		}
+	}
+	return filtered
+}
+
+// getOPTrustChains resolves the valid trust chains of an OP to the configured
+// trust anchors
+func getOPTrustChains(issuer string) ([]opcatalog.TrustChain, error) {
+	var chains []opcatalog.TrustChain
+	found, err := cache.Get(cache.KeyOPTrustChains, issuer, &chains)
+	if err != nil {
+		log.WithError(err).Error("failed to obtain op trust chains from cache")
+	}
+	if found {
+		return chains, nil
+	}
+	resolver := oidfed.TrustResolver{
+		TrustAnchors:   federationLeafEntity.TrustAnchors,
+		StartingEntity: issuer,
+		Types:          []string{oidfedconst.EntityTypeOpenIDProvider},
+	}
+	for _, chain := range resolver.ResolveToValidChains() {
+		if len(chain) == 0 {
+			continue
+		}
+		var c opcatalog.TrustChain
+		for i, stmt := range chain {
+			if i == 0 && len(chain) > 1 {
+				continue
+			}
+			if !slices.Contains(c.Entities, stmt.Issuer) {
+				c.Entities = append(c.Entities, stmt.Issuer)
+			}
+		}
+		ta := chain[len(chain)-1]
+		for _, tm := range chain[0].TrustMarks.VerifiedFederation(&ta.EntityStatementPayload) {
+			c.TrustMarks = append(c.TrustMarks, tm.TrustMarkType)
+		}
+		chains = append(chains, c)
+	}
+	if len(chains) == 0 {
+		return nil, errors.Errorf("no valid trust chain found for '%s'", issuer)
+	}
+	if err = cache.Set(cache.KeyOPTrustChains, issuer, chains, opTrustChainsCacheLifetime); err != nil {
+		log.WithError(err).Error("failed to cache op trust chains")
+	}
+	return chains, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/go-oidfed/offa/internal/opcatalog"
+)
+
+func TestOPRestrictionFilterOPs(t *testing.T) {
+	const (
+		ta           = "https://ta.example.org"
+		intermediate = "https://im.example.org"
+		sirtfi       = "https://refeds.org/sirtfi"
+		other        = "https://tm.example.org/other"
+	)
+	ops := []opcatalog.OP{
+		{
+			EntityID: "https://op1.example.org",
+			TrustChains: []opcatalog.TrustChain{
+				{
+					Entities:   []string{intermediate, ta},
+					TrustMarks: []string{sirtfi},
+				},
+			},
+		},
+		{
+			EntityID: "https://op2.example.org",
+			TrustChains: []opcatalog.TrustChain{
+				{Entities: []string{ta}},
+			},
+		},
+		{
+			EntityID: "https://op3.example.org",
+			TrustChains: []opcatalog.TrustChain{
+				{Entities: []string{intermediate, ta}},
+				{
+					Entities:   []string{"https://other-ta.example.org"},
+					TrustMarks: []string{sirtfi, other},
+				},
+			},
+		},
+		{EntityID: "https://op4.example.org"},
+	}
+	tests := []struct {
+		name        string
+		restriction opRestriction
+		expected    []string
+	}{
+		{
+			name: "empty",
+			expected: []string{
+				"https://op1.example.org", "https://op2.example.org", "https://op3.example.org",
+				"https://op4.example.org",
+			},
+		},
+		{
+			name:        "issuers",
+			restriction: opRestriction{Issuers: []string{"https://op2.example.org", "https://op4.example.org"}},
+			expected:    []string{"https://op2.example.org", "https://op4.example.org"},
+		},
+		{
+			name:        "trust anchor",
+			restriction: opRestriction{TrustAnchors: []string{ta}},
+			expected:    []string{"https://op1.example.org", "https://op2.example.org", "https://op3.example.org"},
+		},
+		{
+			name:        "intermediate",
+			restriction: opRestriction{TrustAnchors: []string{intermediate}},
+			expected:    []string{"https://op1.example.org", "https://op3.example.org"},
+		},
+		{
+			name:        "trust mark",
+			restriction: opRestriction{TrustMarks: []string{sirtfi}},
+			expected:    []string{"https://op1.example.org", "https://op3.example.org"},
+		},
+		{
+			name: "trust mark must be valid in the same chain",
+			restriction: opRestriction{
+				TrustAnchors: []string{intermediate},
+				TrustMarks:   []string{other},
+			},
+		},
+		{
+			name: "issuer and trust mark",
+			restriction: opRestriction{
+				Issuers:    []string{"https://op2.example.org", "https://op3.example.org"},
+				TrustMarks: []string{sirtfi},
+			},
+			expected: []string{"https://op3.example.org"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				var ids []string
+				for _, op := range test.restriction.filterOPs(ops) {
+					ids = append(ids, op.EntityID)
+				}
+				if !slices.Equal(ids, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, ids)
+				}
+			},
+		)
+	}
+}
+
+func TestOPRestrictionAllowsIssuers(t *testing.T) {
+	restriction := opRestriction{Issuers: []string{"https://op.example.org"}}
+	if !restriction.allows("https://op.example.org") {
+		t.Error("expected allowed issuer to be allowed")
+	}
+	if restriction.allows("https://other.example.org") {
+		t.Error("expected other issuer not to be allowed")
+	}
+	if restriction.allows("") {
+		t.Error("expected empty issuer not to be allowed")
+	}
+	if !(opRestriction{}).allows("") {
+		t.Error("expected empty restriction to allow everything")
+	}
+}
+
+func TestOPRestrictionQueryRoundTrip(t *testing.T) {
+	restriction := opRestriction{
+		Issuers:      []string{"https://op1.example.org", "https://op2.example.org"},
+		TrustAnchors: []string{"https://ta.example.org"},
+		TrustMarks:   []string{"https://refeds.org/sirtfi"},
+	}
+	q := url.Values{}
+	restriction.addToQuery(q)
+	parsed := opRestriction{
+		Issuers:      q[queryAllowedIssuer],
+		TrustAnchors: q[queryAllowedTrustAnchor],
+		TrustMarks:   q[queryRequiredTrustMark],
+	}
+	if !reflect.DeepEqual(parsed, restriction) {
+		t.Errorf("expected %v, got %v", restriction, parsed)
+	}
+}
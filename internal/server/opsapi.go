@@ -0,0 +1,81 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/opcatalog"
+)
+
+const (
+	opsAPIDefaultLimit = 20
+	opsAPIMaxLimit     = 100
+)
+
+type opsAPIOP struct {
+	EntityID         string   `json:"entity_id"`
+	DisplayName      string   `json:"display_name"`
+	OrganizationName string   `json:"organization_name,omitempty"`
+	Domain           string   `json:"domain,omitempty"`
+	LogoURI          string   `json:"logo_uri,omitempty"`
+	InformationURI   string   `json:"information_uri,omitempty"`
+	Keywords         []string `json:"keywords,omitempty"`
+}
+
+type opsAPIResponse struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	OPs    []opsAPIOP `json:"ops"`
+}
+
+func addOPsAPIHandler(s fiber.Router) {
+	s.Get(config.Get().Server.Paths.OPsAPI, handleOPsAPI)
+}
+
+// handleOPsAPI searches the OPs of the op catalog. The same OP restriction
+// query parameters as for the login page are supported.
+func handleOPsAPI(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", opsAPIDefaultLimit)
+	if limit <= 0 || limit > opsAPIMaxLimit {
+		limit = opsAPIMaxLimit
+	}
+	offset := max(c.QueryInt("offset"), 0)
+	lang := c.Query("lang")
+	if lang == "" {
+		// Use the most preferred language of the Accept-Language header
+		lang, _, _ = strings.Cut(c.Get(fiber.HeaderAcceptLanguage), ",")
+		lang, _, _ = strings.Cut(lang, ";")
+		lang = strings.TrimSpace(lang)
+	}
+
+	ops, total := opcatalog.Search(
+		opRestrictionFromQuery(c).filterOPs(opCatalog.OPs()), opcatalog.SearchRequest{
+			Query:  c.Query("q"),
+			Lang:   lang,
+			LastOP: getLastOPID(c),
+			Offset: offset,
+			Limit:  limit,
+		},
+	)
+	res := opsAPIResponse{
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		OPs:    make([]opsAPIOP, len(ops)),
+	}
+	for i, op := range ops {
+		res.OPs[i] = opsAPIOP{
+			EntityID:         op.EntityID,
+			DisplayName:      op.LocalizedDisplayName(lang),
+			OrganizationName: op.OrganizationName,
+			Domain:           op.Domain(),
+			LogoURI:          op.LogoURI,
+			InformationURI:   op.InformationURI,
+			Keywords:         strings.Fields(op.KeyWords),
+		}
+	}
+	return c.JSON(res)
+}
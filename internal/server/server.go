@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
@@ -32,19 +33,29 @@ var requestObjectProducer *oidfed.RequestObjectProducer
 var scopes string
 var redirectURI string
 var fullLoginPath string
-var fullAuthPath string
+var fullLogoutPath string
+var fullBackchannelLogoutPath string
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
 
 // Init initializes the server
 func Init() {
-	scheduleBuildOPOptions()
 	initHtmls()
 	initFederationEntity()
+	// The op filters use the federation entity, so it must be initialized
+	// before the ops are collected
+	initOPCatalog()
 	server = fiber.New(serverConfig)
 	addMiddlewares(server)
 	addFederationEndpoints(server)
+	addAssertionEndpoints(server)
 	addAuthHandlers(server)
+	addExtAuthzHandlers(server)
 	addLoginHandlers(server)
+	addOPsAPIHandler(server)
+	addLogoutHandlers(server)
 	addUserPageHandler(server)
+	addAdminHandlers(server)
 }
 
 func initFederationEntity() {
@@ -55,42 +66,50 @@ func initFederationEntity() {
 		redirectURI = fedConfig.EntityID + "/redirect"
 	}
 	fullLoginPath = fedConfig.EntityID + getFullPath(config.Get().Server.Paths.Login)
-	fullAuthPath = fedConfig.EntityID + getFullPath(config.Get().Server.Paths.ForwardAuth)
+	fullLogoutPath = fedConfig.EntityID + getFullPath(config.Get().Server.Paths.Logout)
+	fullBackchannelLogoutPath = fedConfig.EntityID + getFullPath(config.Get().Server.Paths.BackchannelLogout)
 	scopes = strings.Join(fedConfig.Scopes, " ")
 	if scopes == "" {
 		scopes = "openid profile email"
 	}
+	grantTypes := []string{"authorization_code"}
+	if config.Get().SessionStorage.RefreshTokens {
+		grantTypes = append(grantTypes, "refresh_token")
+	}
 	requestObjectProducer = oidfed.NewRequestObjectProducer(
 		fedConfig.EntityID, internal.GetKey(internal.OIDCSigningKeyName), jwa.ES512(), 60,
 	)
 
 	metadata := &oidfed.Metadata{
 		RelyingParty: &oidfed.OpenIDRelyingPartyMetadata{
-			Scope:                       scopes,
-			RedirectURIS:                []string{redirectURI},
-			ResponseTypes:               []string{"code"},
-			GrantTypes:                  []string{"authorization_code"},
-			ApplicationType:             "web",
-			Contacts:                    fedConfig.Contacts,
-			ClientName:                  fedConfig.ClientName,
-			LogoURI:                     fedConfig.LogoURI,
-			ClientURI:                   fedConfig.ClientURI,
-			PolicyURI:                   fedConfig.PolicyURI,
-			TOSURI:                      fedConfig.TOSURI,
-			TokenEndpointAuthMethod:     "private_key_jwt",
-			TokenEndpointAuthSigningAlg: jwa.ES512().String(),
-			InitiateLoginURI:            fullLoginPath,
-			SoftwareID:                  version.SOFTWAREID,
-			SoftwareVersion:             version.VERSION,
-			ClientRegistrationTypes:     []string{"automatic"},
-			Extra:                       fedConfig.ExtraRPMetadata,
-			JWKS:                        internal.GetJWKS(internal.OIDCSigningKeyName),
-			DisplayName:                 fedConfig.DisplayName,
-			Description:                 fedConfig.Description,
-			Keywords:                    fedConfig.Keywords,
-			InformationURI:              fedConfig.InformationURI,
-			OrganizationName:            fedConfig.OrganizationName,
-			OrganizationURI:             fedConfig.OrganizationURI,
+			Scope:                            scopes,
+			RedirectURIS:                     []string{redirectURI},
+			ResponseTypes:                    []string{"code"},
+			GrantTypes:                       grantTypes,
+			ApplicationType:                  "web",
+			Contacts:                         fedConfig.Contacts,
+			ClientName:                       fedConfig.ClientName,
+			LogoURI:                          fedConfig.LogoURI,
+			ClientURI:                        fedConfig.ClientURI,
+			PolicyURI:                        fedConfig.PolicyURI,
+			TOSURI:                           fedConfig.TOSURI,
+			TokenEndpointAuthMethod:          "private_key_jwt",
+			TokenEndpointAuthSigningAlg:      jwa.ES512().String(),
+			InitiateLoginURI:                 fullLoginPath,
+			PostLogoutRedirectURIs:           []string{fullLogoutPath},
+			BackchannelLogoutURI:             fullBackchannelLogoutPath,
+			BackchannelLogoutSessionRequired: true,
+			SoftwareID:                       version.SOFTWAREID,
+			SoftwareVersion:                  version.VERSION,
+			ClientRegistrationTypes:          []string{"automatic"},
+			Extra:                            fedConfig.ExtraRPMetadata,
+			JWKS:                             internal.GetJWKS(internal.OIDCSigningKeyName),
+			DisplayName:                      fedConfig.DisplayName,
+			Description:                      fedConfig.Description,
+			Keywords:                         fedConfig.Keywords,
+			InformationURI:                   fedConfig.InformationURI,
+			OrganizationName:                 fedConfig.OrganizationName,
+			OrganizationURI:                  fedConfig.OrganizationURI,
 		},
 		FederationEntity: &oidfed.FederationEntityMetadata{
 			OrganizationName: fedConfig.OrganizationName,
@@ -145,6 +164,9 @@ func start(s *fiber.App) {
 
 // Start starts the server
 func Start() {
+	if port := config.Get().Server.ExtAuthz.GRPCPort; port != 0 {
+		go startExtAuthzGRPC(port)
+	}
 	start(server)
 }
 
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-oidfed/lib"
+	"github.com/gofiber/fiber/v2"
+	"github.com/lestrrat-go/jwx/v3/jws"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal"
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func setSessionCookie(c *fiber.Ctx, sessionID string, session model.Session) {
+	maxAge := int(time.Until(session.ExpiresAt).Round(time.Second).Seconds())
+	if config.Get().SessionStorage.SlidingExpiration {
+		// With sliding expiration the session lifetime is controlled
+		// server-side, so the cookie lives as long as the browser session
+		maxAge = 0
+	}
+	c.Cookie(
+		&fiber.Cookie{
+			Name:     config.Get().SessionStorage.CookieName,
+			Value:    sessionID,
+			Domain:   config.Get().SessionStorage.CookieDomain,
+			MaxAge:   maxAge,
+			HTTPOnly: true,
+			Secure:   config.Get().Server.Secure,
+			SameSite: "none",
+		},
+	)
+}
+
+// sessionExpiresAt returns when the session expires if it is (re)set now,
+// i.e. after the configured ttl but not after the max lifetime since the
+// login
+func sessionExpiresAt(session model.Session) time.Time {
+	expiresAt := time.Now().Add(time.Duration(config.Get().SessionStorage.TTL) * time.Second)
+	if end, ok := sessionLifetimeEnd(session); ok && end.Before(expiresAt) {
+		return end
+	}
+	return expiresAt
+}
+
+// sessionLifetimeEnd returns when the max lifetime of the session ends; if
+// no max lifetime is configured false is returned
+func sessionLifetimeEnd(session model.Session) (time.Time, bool) {
+	maxLifetime := config.Get().SessionStorage.MaxLifetime
+	if maxLifetime <= 0 || session.LoginTime.IsZero() {
+		return time.Time{}, false
+	}
+	return session.LoginTime.Add(time.Duration(maxLifetime) * time.Second), true
+}
+
+// sessionsInRevalidation holds the ids of sessions that are currently
+// revalidated, so that concurrent requests do not use the same refresh token
+// multiple times
+var sessionsInRevalidation sync.Map
+
+func sessionNeedsRevalidation(session model.Session) bool {
+	interval := config.Get().SessionStorage.RevalidationInterval
+	return interval > 0 && session.EncryptedRefreshToken != "" &&
+		time.Since(session.LastValidated) > time.Duration(interval)*time.Second
+}
+
+// sessionNeedsExtension checks if a session should be extended because of
+// sliding expiration. To not write the session on every request, it is only
+// extended once 10% of its lifetime have passed. Sessions are not extended
+// beyond their max lifetime.
+func sessionNeedsExtension(session model.Session) bool {
+	if !config.Get().SessionStorage.SlidingExpiration {
+		return false
+	}
+	if end, ok := sessionLifetimeEnd(session); ok && !session.ExpiresAt.Before(end) {
+		return false
+	}
+	ttl := time.Duration(config.Get().SessionStorage.TTL) * time.Second
+	return time.Until(session.ExpiresAt) < ttl-ttl/10
+}
+
+// deleteSession deletes the session and removes it from the session index;
+// errors are only logged
+func deleteSession(sessionID string, session model.Session) {
+	if err := cache.DeleteSession(sessionID); err != nil {
+		log.WithError(err).Error("failed to delete session")
+	}
+	if err := cache.UnindexSession(sessionID, session.Claims); err != nil {
+		log.WithError(err).Error("failed to remove session from session index")
+	}
+}
+
+// refreshSession checks if the session must be revalidated or extended and
+// does so. If the revalidation fails, the session is deleted and an error
+// is returned; failing to store an updated session is only logged.
+func refreshSession(sessionID string, session model.Session) (model.Session, error) {
+	if end, ok := sessionLifetimeEnd(session); ok && time.Now().After(end) {
+		deleteSession(sessionID, session)
+		return session, errors.New("session exceeded its max lifetime")
+	}
+	if sessionNeedsRevalidation(session) {
+		if _, inProgress := sessionsInRevalidation.LoadOrStore(sessionID, true); inProgress {
+			return session, nil
+		}
+		defer sessionsInRevalidation.Delete(sessionID)
+		s, err := revalidateSession(session)
+		if err != nil {
+			deleteSession(sessionID, session)
+			return session, err
+		}
+		session = s
+	} else if !sessionNeedsExtension(session) {
+		return session, nil
+	}
+	if config.Get().SessionStorage.SlidingExpiration {
+		session.ExpiresAt = sessionExpiresAt(session)
+	}
+	if err := cache.SetSession(sessionID, session); err != nil {
+		log.WithError(err).Error("failed to update session")
+	}
+	return session, nil
+}
+
+// revalidateSession uses the session's refresh token to obtain new tokens
+// and updates the session's claims from the new id token and the userinfo
+// endpoint
+func revalidateSession(session model.Session) (model.Session, error) {
+	issuer, _ := session.Claims.GetString("iss")
+	refreshToken, err := internal.Decrypt(session.EncryptedRefreshToken)
+	if err != nil {
+		return session, errors.Wrap(err, "could not decrypt refresh token")
+	}
+	tokenRes, errRes, err := refreshTokens(issuer, refreshToken)
+	if err != nil {
+		return session, err
+	}
+	if errRes != nil {
+		return session, errors.Errorf("token refresh failed: %s: %s", errRes.Error, errRes.ErrorDescription)
+	}
+
+	var claims model.UserClaims
+	if tokenRes.IDToken != "" {
+		claims, err = verifyIDToken(tokenRes.IDToken, issuer)
+		if err != nil {
+			return session, err
+		}
+		oldSub, _ := session.Claims.GetString("sub")
+		if sub, _ := claims.GetString("sub"); sub != oldSub {
+			return session, newTokenValidationError(
+				"id token subject mismatch", "the refreshed id token is for a different subject",
+			)
+		}
+		session.IDToken = tokenRes.IDToken
+	} else {
+		// The stored id token was already verified at login, so its claims
+		// are used as the base again
+		msg, err := jws.ParseString(session.IDToken)
+		if err != nil {
+			return session, errors.WithStack(err)
+		}
+		if err = json.Unmarshal(msg.Payload(), &claims); err != nil {
+			return session, errors.WithStack(err)
+		}
+	}
+	if err = addUserinfoClaims(claims, issuer, tokenRes.AccessToken); err != nil {
+		return session, err
+	}
+	if tokenRes.RefreshToken != "" && tokenRes.RefreshToken != refreshToken {
+		session.EncryptedRefreshToken, err = internal.Encrypt(tokenRes.RefreshToken)
+		if err != nil {
+			return session, err
+		}
+	}
+	session.Claims = claims
+	session.LastValidated = time.Now()
+	log.WithField("iss", issuer).Debug("Revalidated session")
+	return session, nil
+}
+
+// refreshTokens uses a refresh token at the token endpoint of the passed OP
+// authenticating with private_key_jwt
+func refreshTokens(issuer, refreshToken string) (*oidfed.OIDCTokenResponse, *oidfed.OIDCErrorResponse, error) {
+	opMetadata, err := federationLeafEntity.ResolveOPMetadata(issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := privateKeyJWTParams(opMetadata.TokenEndpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	params.Set("grant_type", "refresh_token")
+	params.Set("refresh_token", refreshToken)
+
+	res, err := httpClient.PostForm(opMetadata.TokenEndpoint, params)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	var errRes oidfed.OIDCErrorResponse
+	if err = json.Unmarshal(body, &errRes); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if errRes.Error != "" {
+		return nil, &errRes, nil
+	}
+	var tokenRes oidfed.OIDCTokenResponse
+	if err = json.Unmarshal(body, &tokenRes); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return &tokenRes, nil, nil
+}
+
+// privateKeyJWTParams returns the parameters to authenticate at the passed
+// endpoint of an OP with private_key_jwt
+func privateKeyJWTParams(endpoint string) (url.Values, error) {
+	clientAssertion, err := requestObjectProducer.ClientAssertion(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("client_id", config.Get().Federation.EntityID)
+	params.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	params.Set("client_assertion", string(clientAssertion))
+	return params, nil
+}
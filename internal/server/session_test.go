@@ -0,0 +1,181 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/offa/internal/cache"
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func withSessionConf(t *testing.T, ttl, maxLifetime int, sliding bool) {
+	t.Helper()
+	conf := &config.Get().SessionStorage
+	old := *conf
+	t.Cleanup(func() { *conf = old })
+	conf.TTL = ttl
+	conf.MaxLifetime = maxLifetime
+	conf.SlidingExpiration = sliding
+}
+
+func TestSessionExpiresAt(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		maxLifetime int
+		loginTime   time.Time
+		expected    time.Time
+	}{
+		{
+			name:      "no max lifetime",
+			loginTime: now.Add(-10 * time.Hour),
+			expected:  now.Add(time.Hour),
+		},
+		{
+			name:        "max lifetime not reached",
+			maxLifetime: 86400,
+			loginTime:   now.Add(-time.Hour),
+			expected:    now.Add(time.Hour),
+		},
+		{
+			name:        "capped by max lifetime",
+			maxLifetime: 7200,
+			loginTime:   now.Add(-90 * time.Minute),
+			expected:    now.Add(30 * time.Minute),
+		},
+		{
+			name:        "unknown login time",
+			maxLifetime: 7200,
+			expected:    now.Add(time.Hour),
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				withSessionConf(t, 3600, test.maxLifetime, true)
+				expiresAt := sessionExpiresAt(model.Session{LoginTime: test.loginTime})
+				if d := expiresAt.Sub(test.expected).Abs(); d > time.Second {
+					t.Errorf("expected %v, got %v", test.expected, expiresAt)
+				}
+			},
+		)
+	}
+}
+
+func TestSessionNeedsExtension(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		sliding     bool
+		maxLifetime int
+		session     model.Session
+		expected    bool
+	}{
+		{
+			name:    "no sliding expiration",
+			session: model.Session{ExpiresAt: now.Add(time.Minute)},
+		},
+		{
+			name:     "extended",
+			sliding:  true,
+			session:  model.Session{ExpiresAt: now.Add(time.Minute)},
+			expected: true,
+		},
+		{
+			name:    "recently extended",
+			sliding: true,
+			session: model.Session{ExpiresAt: now.Add(59 * time.Minute)},
+		},
+		{
+			name:        "at max lifetime",
+			sliding:     true,
+			maxLifetime: 3600,
+			session: model.Session{
+				LoginTime: now.Add(-59 * time.Minute),
+				ExpiresAt: now.Add(time.Minute),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				withSessionConf(t, 3600, test.maxLifetime, test.sliding)
+				if got := sessionNeedsExtension(test.session); got != test.expected {
+					t.Errorf("expected %v, got %v", test.expected, got)
+				}
+			},
+		)
+	}
+}
+
+func TestRefreshSessionMaxLifetime(t *testing.T) {
+	withSessionConf(t, 3600, 3600, true)
+	session := model.Session{
+		Claims:    model.UserClaims{"sub": "user"},
+		LoginTime: time.Now().Add(-2 * time.Hour),
+		ExpiresAt: time.Now().Add(time.Minute),
+	}
+	if _, err := refreshSession("expired-session", session); err == nil {
+		t.Error("expected session exceeding its max lifetime to be rejected")
+	}
+	session.LoginTime = time.Now().Add(-time.Minute)
+	session.ExpiresAt = time.Now().Add(59 * time.Minute)
+	if _, err := refreshSession("valid-session", session); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRefreshSessionUnindexesDeletedSessions(t *testing.T) {
+	const issuer = "https://op-refresh.example.org"
+	tests := []struct {
+		name      string
+		sessionID string
+		session   model.Session
+	}{
+		{
+			name:      "max lifetime exceeded",
+			sessionID: "session-max-lifetime",
+			session: model.Session{
+				Claims:    model.UserClaims{"iss": issuer, "sub": "max-lifetime", "sid": "max-lifetime"},
+				LoginTime: time.Now().Add(-2 * time.Hour),
+				ExpiresAt: time.Now().Add(time.Minute),
+			},
+		},
+		{
+			name:      "revalidation failed",
+			sessionID: "session-revalidation",
+			session: model.Session{
+				Claims:                model.UserClaims{"iss": issuer, "sub": "revalidation", "sid": "revalidation"},
+				LoginTime:             time.Now().Add(-time.Minute),
+				ExpiresAt:             time.Now().Add(time.Minute),
+				EncryptedRefreshToken: "not-encrypted",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				withSessionConf(t, 3600, 3600, false)
+				config.Get().SessionStorage.RevalidationInterval = 60
+				if err := cache.SetSession(test.sessionID, test.session); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := refreshSession(test.sessionID, test.session); err == nil {
+					t.Fatal("expected refresh to fail")
+				}
+				var session model.Session
+				if found, _ := cache.GetSession(test.sessionID, &session); found {
+					t.Error("expected session to be deleted")
+				}
+				sub, _ := test.session.Claims.GetString("sub")
+				if n, err := cache.RevokeSessions(issuer, sub, ""); err != nil || n != 0 {
+					t.Errorf("expected session to be removed from the sub index, got %d sessions (%v)", n, err)
+				}
+				if n, err := cache.RevokeSessions(issuer, "", sub); err != nil || n != 0 {
+					t.Errorf("expected session to be removed from the sid index, got %d sessions (%v)", n, err)
+				}
+			},
+		)
+	}
+}
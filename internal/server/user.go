@@ -1,8 +1,7 @@
 package server
 
 import (
-	"io"
-	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 
@@ -16,55 +15,57 @@ func addUserPageHandler(s fiber.Router) {
 	s.Get(
 		"/", func(c *fiber.Ctx) error {
 			sub := c.Get("X-Forwarded-Sub")
-			if sub != "" {
-				return renderHeaders(c, c.GetReqHeaders())
+			target := c.Query("target")
+			if sub != "" && target == "" {
+				return renderHeaders(c, c.GetReqHeaders(), "")
 			}
-			req, err := http.NewRequest("GET", fullAuthPath, nil)
-			if err != nil {
-				c.Status(fiber.StatusInternalServerError)
-				return renderError(c, "Internal Server Error", err.Error())
+			req := authRequest{
+				Path:      "/",
+				Method:    fiber.MethodGet,
+				ClientIP:  c.IP(),
+				SessionID: c.Cookies(config.Get().SessionStorage.CookieName),
+				Preview:   true,
 			}
-			req.Header.Set("X-Forwarded-Uri", "/")
-			req.AddCookie(
-				&http.Cookie{
-					Name:  config.Get().SessionStorage.CookieName,
-					Value: c.Cookies(config.Get().SessionStorage.CookieName),
-				},
-			)
-			resp, err := (&http.Client{
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				},
-			}).Do(req)
-			if err != nil {
-				c.Status(fiber.StatusInternalServerError)
-				return renderError(c, "Internal Server Error", err.Error())
+			if target != "" {
+				// Show the headers that would be forwarded for a request to
+				// the target, after include / exclude filtering and the
+				// header size policy were applied
+				u, err := url.Parse(target)
+				if err != nil || u.Host == "" {
+					c.Status(fiber.StatusBadRequest)
+					return renderError(c, "Bad Request", "invalid target url")
+				}
+				req.Host = u.Host
+				req.Path = u.RequestURI()
+				req.Scheme = u.Scheme
 			}
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				c.Status(fiber.StatusInternalServerError)
-				return renderError(c, "Internal Server Error", err.Error())
+			res := authorize(req)
+			if res.Allowed() {
+				headers := make(map[string][]string, len(res.Headers))
+				for h, v := range res.Headers {
+					headers[h] = []string{v}
+				}
+				return renderHeaders(c, headers, target)
 			}
-			if resp.StatusCode == http.StatusOK {
-				return renderHeaders(c, resp.Header)
+			if fasthttp.StatusCodeIsRedirect(res.Status) {
+				return c.Redirect(res.Headers[fiber.HeaderLocation], res.Status)
 			}
-			if fasthttp.StatusCodeIsRedirect(resp.StatusCode) {
-				c.Status(resp.StatusCode)
-				return c.Redirect(resp.Header.Get(fiber.HeaderLocation))
-			}
-			return renderError(c, "error", string(body))
+			c.Status(res.Status)
+			return renderError(c, "error", res.Body)
 		},
 	)
 }
 
-func renderHeaders(c *fiber.Ctx, headers map[string][]string) error {
+// renderHeaders renders the user page with the passed headers; if no target
+// is passed only the oidc headers are shown
+func renderHeaders(c *fiber.Ctx, headers map[string][]string, target string) error {
 	type headerData struct {
 		Header string
 		Value  string
 	}
 	var hd []headerData
 	for h, vs := range headers {
-		if strings.HasPrefix(strings.ToLower(h), "oidc") {
+		if target != "" || strings.HasPrefix(strings.ToLower(h), "oidc") {
 			hd = append(
 				hd, headerData{
 					Header: h,
@@ -78,10 +79,15 @@ func renderHeaders(c *fiber.Ctx, headers map[string][]string) error {
 			return hd[i].Header < hd[j].Header
 		},
 	)
+	username := c.Get("X-Forwarded-User")
+	if vs := headers["X-Forwarded-User"]; username == "" && len(vs) > 0 {
+		username = vs[0]
+	}
 	return render(
 		c, "user", map[string]interface{}{
 			"headers":  hd,
-			"username": c.Get("X-Forwarded-User"),
+			"username": username,
+			"target":   target,
 		},
 	)
 }
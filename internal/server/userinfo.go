@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-oidfed/offa/internal/config"
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+const contentTypeJWT = "application/jwt"
+
+// fetchUserinfo obtains the claims from the userinfo endpoint of the passed
+// OP using the passed access token. The userinfo endpoint is taken from the
+// OP's metadata as resolved through the federation. If the OP does not have
+// a userinfo endpoint, nil is returned.
+func fetchUserinfo(issuer, accessToken string) (model.UserClaims, error) {
+	opMetadata, err := federationLeafEntity.ResolveOPMetadata(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if opMetadata.UserinfoEndpoint == "" {
+		log.WithField("issuer", issuer).Debug("OP does not have a userinfo endpoint")
+		return nil, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, opMetadata.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+accessToken)
+	req.Header.Set(fiber.HeaderAccept, fmt.Sprintf("%s, %s", fiber.MIMEApplicationJSON, contentTypeJWT))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("userinfo endpoint returned status %d: %s", resp.StatusCode, body)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get(fiber.HeaderContentType))
+	signed := mediaType == contentTypeJWT
+	if signed {
+		body, err = verifyOPSignedJWT(string(body), issuer)
+		if err != nil {
+			return nil, newTokenValidationError("invalid userinfo signature", err.Error())
+		}
+	}
+	var claims model.UserClaims
+	if err = json.Unmarshal(body, &claims); err != nil {
+		return nil, errors.Wrap(err, "could not decode userinfo response")
+	}
+	if signed {
+		if iss, ok := claims.GetString("iss"); ok && iss != issuer {
+			return nil, newTokenValidationError(
+				"userinfo issuer mismatch", fmt.Sprintf("expected '%s', got '%s'", issuer, iss),
+			)
+		}
+		if _, ok := claims["aud"]; ok {
+			if err = checkTokenAudience("userinfo", claims); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return claims, nil
+}
+
+// addUserinfoClaims fetches the userinfo claims (if enabled) and merges
+// them into the passed id token claims according to the configured
+// precedence
+func addUserinfoClaims(idTokenClaims model.UserClaims, issuer, accessToken string) error {
+	conf := config.Get().Federation.Userinfo
+	if !conf.Enabled {
+		return nil
+	}
+	userinfo, err := fetchUserinfo(issuer, accessToken)
+	if err != nil {
+		return err
+	}
+	if userinfo == nil {
+		return nil
+	}
+	idSub, _ := idTokenClaims.GetString("sub")
+	uiSub, _ := userinfo.GetString("sub")
+	if idSub != uiSub {
+		return newTokenValidationError(
+			"userinfo subject mismatch", "the sub claim from the userinfo response does not match the id token",
+		)
+	}
+	mergeUserinfo(idTokenClaims, userinfo, conf.Precedence == config.UserinfoPrecedenceUserinfo)
+	return nil
+}
+
+// protocolClaims are registered id token claims that describe the token and
+// the login, not the user; they are never taken from the userinfo response
+var protocolClaims = []model.Claim{
+	"iss",
+	"sub",
+	"aud",
+	"exp",
+	"iat",
+	"nbf",
+	"jti",
+	"nonce",
+	"azp",
+	"sid",
+	"auth_time",
+	"at_hash",
+	"c_hash",
+}
+
+// mergeUserinfo merges the userinfo claims into the id token claims,
+// excluding the protocolClaims regardless of the precedence
+func mergeUserinfo(idTokenClaims, userinfo model.UserClaims, overwrite bool) {
+	filtered := make(model.UserClaims, len(userinfo))
+	for k, v := range userinfo {
+		if !slices.Contains(protocolClaims, k) {
+			filtered[k] = v
+		}
+	}
+	idTokenClaims.Merge(filtered, overwrite)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func TestMergeUserinfo(t *testing.T) {
+	idToken := func() model.UserClaims {
+		return model.UserClaims{
+			"iss":   "https://op.example.org",
+			"sub":   "user",
+			"aud":   testEntityID,
+			"exp":   float64(2000),
+			"sid":   "session",
+			"email": "old@example.org",
+		}
+	}
+	userinfo := model.UserClaims{
+		"iss":       "https://evil.example.org",
+		"sub":       "user",
+		"aud":       "other",
+		"exp":       float64(9999),
+		"iat":       float64(1000),
+		"nonce":     "n",
+		"azp":       "other",
+		"sid":       "other-session",
+		"auth_time": float64(1000),
+		"email":     "new@example.org",
+		"name":      "User",
+	}
+	tests := []struct {
+		name      string
+		overwrite bool
+		expected  model.UserClaims
+	}{
+		{
+			name: "id token precedence",
+			expected: model.UserClaims{
+				"iss":   "https://op.example.org",
+				"sub":   "user",
+				"aud":   testEntityID,
+				"exp":   float64(2000),
+				"sid":   "session",
+				"email": "old@example.org",
+				"name":  "User",
+			},
+		},
+		{
+			name:      "userinfo precedence",
+			overwrite: true,
+			expected: model.UserClaims{
+				"iss":   "https://op.example.org",
+				"sub":   "user",
+				"aud":   testEntityID,
+				"exp":   float64(2000),
+				"sid":   "session",
+				"email": "new@example.org",
+				"name":  "User",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				claims := idToken()
+				mergeUserinfo(claims, userinfo, test.overwrite)
+				if !reflect.DeepEqual(claims, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, claims)
+				}
+			},
+		)
+	}
+}
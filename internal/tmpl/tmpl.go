@@ -0,0 +1,314 @@
+package tmpl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+// Template is a compiled template for a header value
+type Template struct {
+	source   string
+	template *template.Template
+}
+
+// capturesKey is the key under which the captures of the auth rule's
+// regexes are available in the template data
+const capturesKey = "captures"
+
+// Compile compiles a template; the claims of the user are available as
+// '.<claim>', the named capture groups of the auth rule as
+// '.captures.<name>'
+func Compile(name, source string) (*Template, error) {
+	t, err := template.New(name).Funcs(funcs).Parse(source)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, tree := range t.Templates() {
+		if tree.Tree == nil {
+			continue
+		}
+		if err = compileRegexArgs(tree.Tree.Root); err != nil {
+			return nil, err
+		}
+		printMissingAsEmpty(tree.Tree)
+	}
+	return &Template{
+		source:   source,
+		template: t,
+	}, nil
+}
+
+// String returns the source of the template
+func (t *Template) String() string {
+	return t.source
+}
+
+// compileRegexArgs compiles the regexes passed as literal strings to the
+// regex functions, so that invalid regexes are detected when the template is
+// compiled
+func compileRegexArgs(root parse.Node) (err error) {
+	walk(
+		root, func(node parse.Node) {
+			cmd, ok := node.(*parse.CommandNode)
+			if !ok || err != nil || len(cmd.Args) < 2 {
+				return
+			}
+			ident, ok := cmd.Args[0].(*parse.IdentifierNode)
+			if !ok || !slices.Contains(regexFuncs, ident.Ident) {
+				return
+			}
+			if expr, ok := cmd.Args[1].(*parse.StringNode); ok {
+				if _, err = getRegex(expr.Text); err != nil {
+					err = errors.Wrapf(err, "invalid regex for '%s'", ident.Ident)
+				}
+			}
+		},
+	)
+	return
+}
+
+// printMissingAsEmpty pipes the value of every action that prints a value
+// through the printable function, so that missing claims are rendered as
+// empty strings instead of '<no value>'
+func printMissingAsEmpty(tree *parse.Tree) {
+	walk(
+		tree.Root, func(node parse.Node) {
+			action, ok := node.(*parse.ActionNode)
+			if !ok || len(action.Pipe.Decl) > 0 {
+				return
+			}
+			action.Pipe.Cmds = append(
+				action.Pipe.Cmds, &parse.CommandNode{
+					NodeType: parse.NodeCommand,
+					Pos:      action.Pos,
+					Args: []parse.Node{
+						parse.NewIdentifier(printableFunc).SetTree(tree).SetPos(action.Pos),
+					},
+				},
+			)
+		},
+	)
+}
+
+// CaptureNames returns the names of all captures referenced as
+// '.captures.<name>' in the template
+func (t *Template) CaptureNames() (names []string) {
+	for _, tree := range t.template.Templates() {
+		if tree.Tree == nil {
+			continue
+		}
+		walk(
+			tree.Tree.Root, func(node parse.Node) {
+				var ident []string
+				switch n := node.(type) {
+				case *parse.FieldNode:
+					ident = n.Ident
+				case *parse.VariableNode:
+					if len(n.Ident) > 0 && n.Ident[0] == "$" {
+						ident = n.Ident[1:]
+					}
+				}
+				if len(ident) > 1 && ident[0] == capturesKey {
+					names = append(names, ident[1])
+				}
+			},
+		)
+	}
+	return
+}
+
+// walk calls fn for the passed node and all nodes below it
+func walk(node parse.Node, fn func(parse.Node)) {
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return
+	}
+	fn(node)
+	switch n := node.(type) {
+	case *parse.ListNode:
+		for _, c := range n.Nodes {
+			walk(c, fn)
+		}
+	case *parse.ActionNode:
+		walk(n.Pipe, fn)
+	case *parse.PipeNode:
+		for _, v := range n.Decl {
+			walk(v, fn)
+		}
+		for _, c := range n.Cmds {
+			walk(c, fn)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			walk(a, fn)
+		}
+	case *parse.ChainNode:
+		walk(n.Node, fn)
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, fn)
+	case *parse.TemplateNode:
+		walk(n.Pipe, fn)
+	}
+}
+
+func walkBranch(n *parse.BranchNode, fn func(parse.Node)) {
+	walk(n.Pipe, fn)
+	walk(n.List, fn)
+	walk(n.ElseList, fn)
+}
+
+// Execute renders the template for the passed claims and captures. Claims
+// that are not present are rendered as empty strings.
+func (t *Template) Execute(claims model.UserClaims, captures map[string]string) (string, error) {
+	data := make(map[string]any, len(claims)+1)
+	for k, v := range claims {
+		data[string(k)] = v
+	}
+	capturesData := make(map[string]any, len(captures))
+	for k, v := range captures {
+		capturesData[k] = v
+	}
+	data[capturesKey] = capturesData
+	var b strings.Builder
+	if err := t.template.Execute(&b, data); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return b.String(), nil
+}
+
+// printableFunc is the name of the function that is appended to all
+// printing actions
+const printableFunc = "_printable"
+
+// printable returns an empty string for missing values and the value
+// itself otherwise
+func printable(v any) any {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+// regexFuncs are the functions that take a regex as first argument
+var regexFuncs = []string{
+	"regexReplace",
+	"filter",
+}
+
+var funcs = template.FuncMap{
+	"lower":        func(v any) string { return strings.ToLower(toString(v)) },
+	"upper":        func(v any) string { return strings.ToUpper(toString(v)) },
+	"trim":         func(v any) string { return strings.TrimSpace(toString(v)) },
+	"replace":      func(old, new string, v any) string { return strings.ReplaceAll(toString(v), old, new) },
+	"regexReplace": regexReplace,
+	"split":        func(sep string, v any) []string { return strings.Split(toString(v), sep) },
+	"join":         func(sep string, v any) string { return strings.Join(toStrings(v), sep) },
+	"filter":       filter,
+	"first":        first,
+	"default":      defaultValue,
+	"b64enc":       func(v any) string { return base64.StdEncoding.EncodeToString([]byte(toString(v))) },
+	"rfc2047":      func(v any) string { return mime.QEncoding.Encode("utf-8", toString(v)) },
+	"toJSON":       toJSON,
+	printableFunc:  printable,
+}
+
+// toString formats scalar values; other values are json encoded
+func toString(v any) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := model.FormatScalar(v); ok {
+		return s
+	}
+	if s, ok := model.FormatSlice(v); ok {
+		return strings.Join(s, ",")
+	}
+	return toJSON(v)
+}
+
+// toStrings returns the values of a list; a scalar value is returned as
+// single element list
+func toStrings(v any) []string {
+	if v == nil {
+		return nil
+	}
+	if s, ok := model.FormatSlice(v); ok {
+		return s
+	}
+	return []string{toString(v)}
+}
+
+func toJSON(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+var regexCache sync.Map
+
+func getRegex(expr string) (*regexp.Regexp, error) {
+	if re, ok := regexCache.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	regexCache.Store(expr, re)
+	return re, nil
+}
+
+func regexReplace(expr, repl string, v any) (string, error) {
+	re, err := getRegex(expr)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(toString(v), repl), nil
+}
+
+// filter returns the elements of a list that match the regex
+func filter(expr string, v any) ([]string, error) {
+	re, err := getRegex(expr)
+	if err != nil {
+		return nil, err
+	}
+	var matching []string
+	for _, e := range toStrings(v) {
+		if re.MatchString(e) {
+			matching = append(matching, e)
+		}
+	}
+	return matching, nil
+}
+
+func first(v any) string {
+	values := toStrings(v)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func defaultValue(def, v any) any {
+	if v == nil || toString(v) == "" {
+		return def
+	}
+	return v
+}
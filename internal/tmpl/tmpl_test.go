@@ -0,0 +1,149 @@
+package tmpl
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/go-oidfed/offa/internal/model"
+)
+
+func TestExecute(t *testing.T) {
+	claims := model.UserClaims{
+		"email":       "User@Example.org",
+		"given_name":  "Jane",
+		"family_name": "Doe",
+		"groups":      []any{"admin-a", "users", "admin-b"},
+		"note":        "<no value>",
+	}
+	captures := map[string]string{"tenant": "acme"}
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "claim",
+			source:   "{{lower .email}}",
+			expected: "user@example.org",
+		},
+		{
+			name:     "combined claims",
+			source:   `{{print .given_name " " .family_name}}`,
+			expected: "Jane Doe",
+		},
+		{
+			name:     "filter and join",
+			source:   `{{join ";" (filter "^admin-" .groups)}}`,
+			expected: "admin-a;admin-b",
+		},
+		{
+			name:     "missing claim",
+			source:   "{{.locale}}",
+			expected: "",
+		},
+		{
+			name:     "missing nested claim",
+			source:   "{{.address.country}}",
+			expected: "",
+		},
+		{
+			name:     "literal no value is kept",
+			source:   "{{.note}}",
+			expected: "<no value>",
+		},
+		{
+			name:     "variable",
+			source:   "{{$name := .given_name}}{{$name}} {{.missing}}",
+			expected: "Jane ",
+		},
+		{
+			name:     "regex replace",
+			source:   `{{regexReplace "@.*$" "" .email}}`,
+			expected: "User",
+		},
+		{
+			name:     "default",
+			source:   `{{default "en" .locale}}`,
+			expected: "en",
+		},
+		{
+			name:     "capture",
+			source:   "{{.captures.tenant}}-{{.email}}",
+			expected: "acme-User@Example.org",
+		},
+		{
+			name:     "missing capture",
+			source:   "{{.captures.other}}",
+			expected: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				tmpl, err := Compile(test.name, test.source)
+				if err != nil {
+					t.Fatal(err)
+				}
+				value, err := tmpl.Execute(claims, captures)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if value != test.expected {
+					t.Errorf("expected '%s', got '%s'", test.expected, value)
+				}
+			},
+		)
+	}
+}
+
+func TestCompileInvalidRegex(t *testing.T) {
+	for _, source := range []string{
+		`{{regexReplace "(" "" .email}}`,
+		`{{join "," (filter "[a-" .groups)}}`,
+	} {
+		if _, err := Compile("invalid", source); err == nil {
+			t.Errorf("expected error for template '%s'", source)
+		}
+	}
+}
+
+func TestCaptureNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{
+			name:   "none",
+			source: "{{.email}}",
+		},
+		{
+			name:     "field",
+			source:   "{{.captures.tenant}}",
+			expected: []string{"tenant"},
+		},
+		{
+			name:     "nested",
+			source:   `{{if .email}}{{range .groups}}{{$.captures.a}}{{end}}{{else}}{{lower .captures.b}}{{end}}`,
+			expected: []string{"a", "b"},
+		},
+		{
+			name:     "with",
+			source:   `{{with .captures.tenant}}{{.}}{{end}}`,
+			expected: []string{"tenant"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				tmpl, err := Compile(test.name, test.source)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if names := tmpl.CaptureNames(); !slices.Equal(names, test.expected) {
+					t.Errorf("expected %v, got %v", test.expected, names)
+				}
+			},
+		)
+	}
+}
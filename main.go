@@ -21,7 +21,9 @@ func main() {
 	config.MustLoadConfig()
 	logger.Init()
 	cache.Init()
-	internal.InitKeys(internal.FedSigningKeyName, internal.OIDCSigningKeyName)
+	internal.InitKeys(internal.FedSigningKeyName, internal.OIDCSigningKeyName, internal.AssertionSigningKeyName)
+	internal.InitEncryptionKey(internal.SessionEncryptionKeyName)
+	internal.InitSigningKey(internal.CookieSigningKeyName)
 	for _, c := range config.Get().Federation.TrustMarks {
 		if err := c.Verify(
 			config.Get().Federation.EntityID, "",